@@ -0,0 +1,180 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/io"
+)
+
+// Rates tried by baud: auto; NMEA 0183, some GPS, NMEA 0183-HS eg AIS and USB gateways
+var auto_bauds = []int{4800, 9600, 38400, 115200}
+
+const (
+	default_baud_window = 2 * time.Second
+	auto_read_timeout   = 250 * time.Millisecond // so a silent port does not stop the detection
+	degraded_sample     = 20                     // sentences checked at a time for a degraded stream
+)
+
+// The baud setting of a serial device, a rate or auto with the rates to try
+type serialBaud struct {
+	baud   int
+	auto   bool
+	bauds  []int
+	window time.Duration // time reading at each rate
+}
+
+// Parses the baud settings returning errors separated by ";". A baud which
+// is not a number or auto is reported by the baud setting kind.
+func parseSerialBaud(config map[string][]string) (serialBaud, string) {
+	baud := serialBaud{baud: 4800, bauds: auto_bauds, window: default_baud_window}
+	error_str := ""
+	if baud_list, found := config["baud"]; found && len(baud_list) > 0 {
+		if baud_list[0] == "auto" {
+			baud.auto = true
+		} else if rate, err := strconv.ParseInt(baud_list[0], 10, 32); err == nil {
+			baud.baud = int(rate)
+		}
+	}
+	if candidates, found := config["baud_candidates"]; found {
+		baud.bauds = make([]int, 0, len(candidates))
+		for _, candidate := range candidates {
+			if rate, err := strconv.Atoi(candidate); err == nil && rate > 0 {
+				baud.bauds = append(baud.bauds, rate)
+			} else {
+				error_str += fmt.Sprintf("baud_candidates %s is not a baud rate;", candidate)
+			}
+		}
+	}
+	if windows, found := config["baud_window"]; found && len(windows) > 0 {
+		if window, err := strconv.Atoi(windows[0]); err == nil && window > 0 {
+			baud.window = time.Duration(window) * time.Millisecond
+		} else {
+			error_str += fmt.Sprintf("baud_window %s must be a number of ms greater than 0;", windows[0])
+		}
+	}
+	if !baud.auto && (config["baud_candidates"] != nil || config["baud_window"] != nil) {
+		error_str += "baud_candidates and baud_window are only used with baud: auto;"
+	}
+	if baud.auto && len(baud.bauds) > 0 {
+		baud.baud = baud.bauds[0]
+	}
+	return baud, error_str
+}
+
+type baudScore struct {
+	baud      int
+	valid     int
+	checksums int // valid sentences with a correct checksum
+	invalid   int
+}
+
+// Sentences with a correct checksum are the best evidence of the rate
+func (s baudScore) better(than baudScore) bool {
+	if s.checksums != than.checksums {
+		return s.checksums > than.checksums
+	}
+	return s.valid > than.valid
+}
+
+// Reads from the open port at each candidate rate and sets the rate with
+// the most valid sentences with checksums, then without. Returns false if
+// no rate has at least 2 valid sentences.
+func detectBaud(ctx context.Context, name string, ser io.Serial_interfacer, settings serialSettings, log *slog.Logger) (int, bool) {
+	best := baudScore{}
+	for _, baud := range settings.baud.bauds {
+		if err := ser.SetMode(baud, settings.port.Name); err != nil {
+			log.Warn(fmt.Sprintf("Serial device %s could not set %d baud error: %s", name, baud, err))
+			continue
+		}
+		score, err := readBaudScore(ctx, ser, settings.baud.window)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error(fmt.Sprintf("Serial read error on port %s detecting baud rate error: %s", name, err))
+			}
+			return 0, false
+		}
+		score.baud = baud
+		log.Debug(fmt.Sprintf("Serial device %s at %d baud read %d valid (%d with checksums) and %d invalid sentences",
+			name, baud, score.valid, score.checksums, score.invalid))
+		if score.better(best) {
+			best = score
+		}
+	}
+	if best.valid < 2 {
+		return 0, false
+	}
+	if err := ser.SetMode(best.baud, settings.port.Name); err != nil {
+		log.Warn(fmt.Sprintf("Serial device %s could not set %d baud error: %s", name, best.baud, err))
+		return 0, false
+	}
+	log.Info(fmt.Sprintf("Serial device %s baud rate detected as %d from %d valid sentences", name, best.baud, best.valid))
+	return best.baud, true
+}
+
+// Counts the valid and invalid sentences read within the window
+func readBaudScore(ctx context.Context, ser io.Serial_interfacer, window time.Duration) (baudScore, error) {
+	score := baudScore{}
+	buff := make([]byte, 64)
+	framer := newLineFramer(max_line_len)
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil {
+			return score, ctx.Err()
+		}
+		n, err := ser.Read(&buff)
+		if err != nil {
+			return score, err
+		}
+		framer.write(buff[:n])
+		for {
+			line, err := framer.next()
+			if err != nil {
+				// oversize or broken lines are likely at the wrong rate
+				score.invalid++
+				continue
+			}
+			if line == nil {
+				break
+			}
+			if has_checksum, valid := checkSentence(string(line)); valid {
+				score.valid++
+				if has_checksum {
+					score.checksums++
+				}
+			} else {
+				score.invalid++
+			}
+		}
+	}
+	return score, nil
+}
+
+// Checks the sentences read at a detected rate so the rate can be
+// detected again if most of them are invalid eg the instrument was changed
+type baudMonitor struct {
+	checked int
+	invalid int
+}
+
+// Returns true if most of the last sample of sentences were invalid
+func (b *baudMonitor) degraded(str string) bool {
+	if _, valid := checkSentence(str); !valid {
+		b.invalid++
+	}
+	b.checked++
+	if b.checked < degraded_sample {
+		return false
+	}
+	degraded := b.invalid > degraded_sample/2
+	b.checked, b.invalid = 0, 0
+	return degraded
+}
@@ -0,0 +1,341 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Devices can be added in code instead of a config file, eg
+//
+//	mux := nmea_mux.NewMux()
+//	err := mux.AddSerial(nmea_mux.SerialConfig{Name: "compass", Port: "/dev/ttyUSB0", Outputs: []string{"to_processor"}})
+//	...
+//	err = mux.Build()
+//
+// Each Add method checks the settings and Build wires the channels
+// together exactly as LoadConfig does for the same settings in yaml
+
+type SerialConfig struct {
+	Name      string
+	Port      string // eg /dev/ttyUSB0 or COM3
+	Baud      int    // defaults to 4800
+	Input     string // channel of sentences to transmit
+	Outputs   []string
+	OriginTag string
+	Checksum  string // ignore, fix or require
+	Report    []string
+}
+
+type UdpClientConfig struct {
+	Name          string
+	ServerAddress string // host:port
+	Input         string
+	Report        []string
+}
+
+type UdpListenConfig struct {
+	Name      string
+	Port      string
+	Outputs   []string
+	OriginTag string
+	Checksum  string
+	Report    []string
+}
+
+type TcpServerConfig struct {
+	Name       string
+	Port       string
+	Input      string
+	Tap        string // channel copied to clients in place of an input
+	Outputs    []string
+	MaxClients int // defaults to 10
+	OriginTag  string
+	ClientTags map[string]string // origin tag by client ip
+	Checksum   string
+	Report     []string
+}
+
+type TcpClientConfig struct {
+	Name          string
+	ServerAddress string // host:port
+	Input         string
+	Outputs       []string
+	OriginTag     string
+	MaxBackoff    time.Duration // defaults to 30s
+	Checksum      string
+	Report        []string
+}
+
+type ProcessorConfig struct {
+	Name         string
+	Input        string
+	LogPeriod    time.Duration // zero for no log
+	DataRetain   time.Duration
+	DatetimeTags []string
+	AddNowVar    string
+	DataParse    []string
+	Checksum     string
+}
+
+type MakeSentenceConfig struct {
+	Name          string
+	Processor     string
+	Sentence      string // eg hdm
+	Prefix        string // talker ID eg HF
+	Every         time.Duration
+	UseOriginTag  string
+	If            []string // conditions of the form "variable == value"
+	ThenOriginTag string
+	ElseOriginTag string
+	Outputs       []string
+}
+
+func (n *NmeaMux) AddSerial(c SerialConfig) error {
+	error_str := ""
+	if c.Port == "" {
+		error_str += "port must be set;"
+	}
+	if c.Baud < 0 {
+		error_str += "baud must not be negative;"
+	}
+	if c.Input == "" && len(c.Outputs) == 0 {
+		error_str += "an input or outputs must be set;"
+	}
+	error_str += checkChecksumMode(c.Checksum)
+
+	settings := map[string]any{"name": c.Port}
+	if c.Baud > 0 {
+		settings["baud"] = c.Baud
+	}
+	setString(settings, "input", c.Input)
+	setList(settings, "outputs", c.Outputs)
+	setString(settings, "origin_tag", c.OriginTag)
+	setString(settings, "checksum", c.Checksum)
+	setList(settings, "report", c.Report)
+	return n.addSettings(c.Name, "serial", settings, error_str)
+}
+
+func (n *NmeaMux) AddUdpClient(c UdpClientConfig) error {
+	error_str := checkAddress(c.ServerAddress)
+	if c.Input == "" {
+		error_str += "input must be set;"
+	}
+
+	settings := map[string]any{"server_address": c.ServerAddress, "input": c.Input}
+	setList(settings, "report", c.Report)
+	return n.addSettings(c.Name, "udp_client", settings, error_str)
+}
+
+func (n *NmeaMux) AddUdpListen(c UdpListenConfig) error {
+	error_str := checkPort(c.Port)
+	if len(c.Outputs) == 0 {
+		error_str += "outputs must be set;"
+	}
+	error_str += checkChecksumMode(c.Checksum)
+
+	settings := map[string]any{"port": c.Port, "outputs": c.Outputs}
+	setString(settings, "origin_tag", c.OriginTag)
+	setString(settings, "checksum", c.Checksum)
+	setList(settings, "report", c.Report)
+	return n.addSettings(c.Name, "udp_listen", settings, error_str)
+}
+
+func (n *NmeaMux) AddTcpServer(c TcpServerConfig) error {
+	error_str := checkPort(c.Port)
+	if c.Input == "" && c.Tap == "" && len(c.Outputs) == 0 {
+		error_str += "an input, tap or outputs must be set;"
+	}
+	if c.Input != "" && c.Tap != "" {
+		error_str += "input and tap cannot both be set;"
+	}
+	if c.MaxClients < 0 {
+		error_str += "max clients must not be negative;"
+	}
+	error_str += checkChecksumMode(c.Checksum)
+
+	settings := map[string]any{"port": c.Port}
+	setString(settings, "input", c.Input)
+	setString(settings, "tap", c.Tap)
+	setList(settings, "outputs", c.Outputs)
+	if c.MaxClients > 0 {
+		settings["max_clients"] = c.MaxClients
+	}
+	setString(settings, "origin_tag", c.OriginTag)
+	if len(c.ClientTags) > 0 {
+		client_tags := make([]string, 0, len(c.ClientTags))
+		for ip, tag := range c.ClientTags {
+			if net.ParseIP(ip) == nil {
+				error_str += fmt.Sprintf("client tag ip %s is not valid;", ip)
+			}
+			client_tags = append(client_tags, fmt.Sprintf("%s == %s", ip, tag))
+		}
+		slices.Sort(client_tags)
+		settings["client_tags"] = client_tags
+	}
+	setString(settings, "checksum", c.Checksum)
+	setList(settings, "report", c.Report)
+	return n.addSettings(c.Name, "tcp_server", settings, error_str)
+}
+
+func (n *NmeaMux) AddTcpClient(c TcpClientConfig) error {
+	error_str := checkAddress(c.ServerAddress)
+	if c.Input == "" && len(c.Outputs) == 0 {
+		error_str += "an input or outputs must be set;"
+	}
+	if c.MaxBackoff != 0 && c.MaxBackoff < time.Second {
+		error_str += "max backoff must be at least 1 second;"
+	}
+	error_str += checkChecksumMode(c.Checksum)
+
+	settings := map[string]any{"server_address": c.ServerAddress}
+	setString(settings, "input", c.Input)
+	setList(settings, "outputs", c.Outputs)
+	setString(settings, "origin_tag", c.OriginTag)
+	if c.MaxBackoff > 0 {
+		settings["max_backoff"] = int(c.MaxBackoff / time.Second)
+	}
+	setString(settings, "checksum", c.Checksum)
+	setList(settings, "report", c.Report)
+	return n.addSettings(c.Name, "tcp_client", settings, error_str)
+}
+
+func (n *NmeaMux) AddProcessor(c ProcessorConfig) error {
+	error_str := ""
+	if c.Input == "" {
+		error_str += "input must be set;"
+	}
+	if c.LogPeriod < 0 || c.DataRetain < 0 {
+		error_str += "log period and data retain must not be negative;"
+	}
+	for _, data := range c.DataParse {
+		if len(data) < 2 {
+			error_str += fmt.Sprintf("data parse %s is too short;", data)
+		}
+	}
+	error_str += checkChecksumMode(c.Checksum)
+
+	settings := map[string]any{"input": c.Input}
+	if c.LogPeriod > 0 {
+		settings["log_period"] = int(c.LogPeriod / time.Second)
+	}
+	if c.DataRetain > 0 {
+		settings["data_retain"] = int(c.DataRetain / time.Second)
+	}
+	setList(settings, "datetime_tags", c.DatetimeTags)
+	setString(settings, "add_now_var", c.AddNowVar)
+	setList(settings, "data_parse", c.DataParse)
+	setString(settings, "checksum", c.Checksum)
+	return n.addSettings(c.Name, "nmea_processor", settings, error_str)
+}
+
+func (n *NmeaMux) AddMakeSentence(c MakeSentenceConfig) error {
+	error_str := ""
+	if c.Processor == "" {
+		error_str += "processor must be set;"
+	}
+	if c.Sentence == "" {
+		error_str += "sentence must be set;"
+	}
+	if c.Prefix != "" && len(c.Prefix) != 2 {
+		error_str += "prefix must be 2 characters;"
+	}
+	if c.Every < 100*time.Millisecond {
+		error_str += "every must be at least 100ms;"
+	}
+	for _, condition := range c.If {
+		if _, ok := parseCondition(condition); !ok {
+			error_str += fmt.Sprintf("Condition %s in %s must be variable == value;", condition, c.Name)
+		}
+	}
+	if len(c.Outputs) == 0 {
+		error_str += "outputs must be set;"
+	}
+
+	settings := map[string]any{
+		"processor": c.Processor,
+		"sentence":  c.Sentence,
+		"every":     int(c.Every / time.Millisecond),
+		"outputs":   c.Outputs,
+	}
+	setString(settings, "prefix", c.Prefix)
+	setString(settings, "use_origin_tag", c.UseOriginTag)
+	setList(settings, "if", c.If)
+	setString(settings, "then_origin_tag", c.ThenOriginTag)
+	setString(settings, "else_origin_tag", c.ElseOriginTag)
+	return n.addSettings(c.Name, "make_sentence", settings, error_str)
+}
+
+// Adds a device of any type, eg filter or throttle, with settings as they
+// would be written in yaml
+func (n *NmeaMux) AddDevice(name string, device_type string, settings map[string]any) error {
+	copied := make(map[string]any, len(settings)+1)
+	for key, value := range settings {
+		copied[key] = value
+	}
+	return n.addSettings(name, device_type, copied, "")
+}
+
+// Wires the channels of the added devices together ready to Run. Errors
+// are as returned by LoadConfig.
+func (n *NmeaMux) Build() error {
+	return n.applyConfig()
+}
+
+func (n *NmeaMux) addSettings(name string, device_type string, settings map[string]any, error_str string) error {
+	if name == "" {
+		error_str += "name must be set;"
+	} else if strings.ContainsAny(name, ". ") || name != strings.ToLower(name) {
+		error_str += "name must be lower case without spaces or dots;"
+	} else if n.settings.IsSet(name) {
+		error_str += "a device of this name has already been added;"
+	}
+	if error_str != "" {
+		return fmt.Errorf("%s %s has these errors:%s", device_type, name, error_str)
+	}
+	settings["type"] = device_type
+	return n.settings.MergeConfigMap(map[string]any{name: settings})
+}
+
+func setString(settings map[string]any, key string, value string) {
+	if value != "" {
+		settings[key] = value
+	}
+}
+
+func setList(settings map[string]any, key string, values []string) {
+	if len(values) > 0 {
+		settings[key] = values
+	}
+}
+
+func checkChecksumMode(mode string) string {
+	switch mode {
+	case "", checksum_ignore, checksum_fix, checksum_require:
+		return ""
+	}
+	return fmt.Sprintf("checksum %s must be ignore, fix or require;", mode)
+}
+
+func checkPort(port string) string {
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Sprintf("port %s must be a number from 1 to 65535;", port)
+	}
+	return ""
+}
+
+func checkAddress(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Sprintf("server address %s must be host:port;", address)
+	}
+	return checkPort(port)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestBuilderMatchesYaml(t *testing.T) {
+	n := NewMux()
+	errs := []error{
+		n.AddSerial(SerialConfig{
+			Name: "compass", Port: "/dev/ttyUSB0", Baud: 38400, OriginTag: "cp_", Checksum: "fix",
+			Outputs: []string{"to_processor"},
+		}),
+		n.AddProcessor(ProcessorConfig{
+			Name: "main_processor", Input: "to_processor", LogPeriod: 15 * time.Second,
+			DataRetain: 30 * time.Second, DatetimeTags: []string{"cp_"},
+		}),
+		n.AddMakeSentence(MakeSentenceConfig{
+			Name: "compass_out", Processor: "main_processor", Sentence: "hdm", Every: 200 * time.Millisecond,
+			Prefix: "HF", UseOriginTag: "cp_", If: []string{"cp_compass_status == 3333"},
+			Outputs: []string{"to_udp_opencpn"},
+		}),
+		n.AddUdpClient(UdpClientConfig{Name: "udp_opencpn", Input: "to_udp_opencpn", ServerAddress: "192.168.1.14:8011"}),
+	}
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Builder failed to add device: %s", err)
+		}
+	}
+	if err := n.Build(); err != nil {
+		t.Errorf("Build failed: %s", err)
+	}
+
+	y := NewMux()
+	if err := y.LoadConfig("./test_data/", "config", "yaml", test_data.Builder_config); err != nil {
+		t.Errorf("Yaml config failed to load: %s", err)
+	}
+	if !reflect.DeepEqual(n.Config.Values, y.Config.Values) {
+		t.Errorf("Builder config differs from yaml\n%v\n%v", n.Config.Values, y.Config.Values)
+	}
+	if len(n.devices) != 3 || n.SerialIoDevices["compass"] == nil || n.UdpClientIoDevices["udp_opencpn"] == nil {
+		t.Errorf("Builder devices not set up got %v", n.devices)
+	}
+	if n.Channels["to_processor"] == nil || n.Channels["to_udp_opencpn"] == nil {
+		t.Error("Builder channels not created")
+	}
+}
+
+func TestBuilderValidates(t *testing.T) {
+	n := NewMux()
+	if err := n.AddSerial(SerialConfig{Name: "compass", Outputs: []string{"to_processor"}, Checksum: "maybe"}); err == nil {
+		t.Error("Serial without a port and a bad checksum must fail")
+	} else if test_helpers.UnexpectedErrorMessage("serial compass has these errors:port must be set;checksum maybe", err) {
+		t.Errorf("Unexpected error %s", err)
+	}
+	if err := n.AddUdpClient(UdpClientConfig{Name: "udp", Input: "to_udp", ServerAddress: "192.168.1.14"}); err == nil {
+		t.Error("Udp client address without a port must fail")
+	}
+	if err := n.AddTcpServer(TcpServerConfig{Name: "tcp", Port: "10110", Input: "to_tcp",
+		ClientTags: map[string]string{"plotter": "pl_"}}); err == nil {
+		t.Error("Tcp server client tag must be an ip")
+	}
+	if err := n.AddTcpServer(TcpServerConfig{Name: "tcp", Port: "10110", Input: "to_tcp", Tap: "to_processor"}); err == nil {
+		t.Error("Tcp server with an input and a tap must fail")
+	}
+	if err := n.AddMakeSentence(MakeSentenceConfig{Name: "hdm_out", Processor: "main_processor", Sentence: "hdm",
+		Every: 10 * time.Millisecond, If: []string{"cp_auto"}, Outputs: []string{"to_udp"}}); err == nil {
+		t.Error("Make sentence with a short every and bad condition must fail")
+	} else if test_helpers.UnexpectedErrorMessage("make_sentence hdm_out has these errors:every must be at least 100ms;Condition cp_auto in hdm_out must be variable == value;", err) {
+		t.Errorf("Unexpected error %s", err)
+	}
+	// conditions are accepted with or without spaces as they are when run
+	if err := n.AddMakeSentence(MakeSentenceConfig{Name: "hdm_out", Processor: "main_processor", Sentence: "hdm",
+		Every: time.Second, If: []string{"cp_auto==1", "cp_mode == 2"}, Outputs: []string{"to_udp"}}); err != nil {
+		t.Errorf("Make sentence with conditions failed to add: %s", err)
+	}
+	if err := n.AddDevice("Filter", "filter", map[string]any{"input": "to_filter"}); err == nil {
+		t.Error("Upper case name must fail")
+	}
+
+	if err := n.AddUdpListen(UdpListenConfig{Name: "listen", Port: "8006", Outputs: []string{"to_processor"}}); err != nil {
+		t.Errorf("Udp listen failed to add: %s", err)
+	}
+	if err := n.AddUdpListen(UdpListenConfig{Name: "listen", Port: "8007", Outputs: []string{"to_processor"}}); err == nil {
+		t.Error("Duplicate name must fail")
+	}
+	if err := n.Build(); !onlyWiringErrors(err) {
+		t.Errorf("Unwired build must report channels got %s", err)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capture files hold one sentence per line in the form
+// <receive time RFC3339Nano> TAB <origin tag> TAB <sentence>
+// so that a passage can be replayed with its original timing
+
+type captureRecord struct {
+	received time.Time
+	tag      string
+	sentence string
+}
+
+func formatCaptureRecord(received time.Time, str string) string {
+	tag, sentence := trim_tag(str)
+	return fmt.Sprintf("%s\t%s\t%s\n", received.UTC().Format(time.RFC3339Nano), tag, sentence)
+}
+
+func parseCaptureRecord(line string) (captureRecord, error) {
+	rec := captureRecord{}
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 3)
+	if len(parts) != 3 {
+		return rec, fmt.Errorf("capture line must have time, tag and sentence: %s", line)
+	}
+	received, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return rec, fmt.Errorf("capture line has bad time: %s", err)
+	}
+	rec.received = received
+	rec.tag = parts[1]
+	rec.sentence = parts[2]
+	return rec, nil
+}
+
+func (n *NmeaMux) recorderProcess(name string) error {
+	// writes every sentence on the input channel to a timestamped capture file
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	directory := "."
+	prefix := "capture"
+
+	if inputs, found := config["input"]; !found || len(inputs) != 1 {
+		log.Error(fmt.Sprintf("Recorder <%s> has invalid number of inputs must be exactly 1", name))
+		return nil
+	}
+	if directories, found := config["directory"]; found && len(directories) > 0 {
+		directory = directories[0]
+	}
+	if prefixes, found := config["file_prefix"]; found && len(prefixes) > 0 {
+		prefix = prefixes[0]
+	}
+
+	file_name := filepath.Join(directory, fmt.Sprintf("%s_%s.txt", prefix, time.Now().UTC().Format("2006-01-02T15_04_05")))
+	f, err := os.Create(file_name)
+	if err != nil {
+		log.Error(fmt.Sprintf("Recorder %s could not create capture file: %s", name, err))
+		return nil
+	}
+	log.Info(fmt.Sprintf("Recorder %s capturing %s to %s", name, config["input"][0], file_name))
+
+	input := config["input"][0]
+	n.goDevice(name, func(ctx context.Context) {
+		recorder(ctx, name, f, input, n.deviceStats(name), n.deviceLogger(name), n.deviceChannels(name))
+	})
+	return nil
+}
+
+func recorder(ctx context.Context, name string, f *os.File, input string, stats *deviceStats, log *slog.Logger,
+	channels *map[string](chan string)) {
+	writer := bufio.NewWriter(f)
+	flush_ticker := time.NewTicker(time.Second)
+	defer func() {
+		flush_ticker.Stop()
+		writer.Flush()
+		f.Close()
+	}()
+
+	for {
+		select {
+		case str := <-(*channels)[input]:
+			stats.received(str)
+			record := formatCaptureRecord(time.Now(), str)
+			if _, err := writer.WriteString(record); err != nil {
+				log.Error(fmt.Sprintf("Recorder %s Error on write: %s", name, err))
+				return
+			}
+			stats.sent(record)
+		case <-flush_ticker.C:
+			writer.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shortest time a looped file takes to play so that a file of one record, or
+// of records with the same time, does not replay at full speed
+const min_loop_pass = time.Second
+
+type playerSettings struct {
+	file_name string
+	outputs   []string
+	speed     float64
+	loop      bool
+	tag       string
+	checksum  *checksumFilter
+	stats     *deviceStats
+}
+
+func (n *NmeaMux) playerProcess(name string) error {
+	// replays a capture file onto the output channels
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	settings := playerSettings{
+		outputs: config["outputs"],
+		speed:   1,
+		tag:     "",
+	}
+
+	if files, found := config["file"]; found && len(files) == 1 {
+		settings.file_name = files[0]
+	} else {
+		log.Error(fmt.Sprintf("Player <%s> must have exactly 1 file", name))
+		return nil
+	}
+	if speeds, found := config["speed"]; found {
+		if speed, err := strconv.ParseFloat(speeds[0], 64); err == nil && speed > 0 {
+			settings.speed = speed
+		} else {
+			log.Error(fmt.Sprintf("Player <%s> speed must be a number greater than 0", name))
+			return nil
+		}
+	}
+	if loops, found := config["loop"]; found && len(loops) > 0 && loops[0] == "on" {
+		settings.loop = true
+	}
+	if origin_tags, found := config["origin_tag"]; found && len(origin_tags) > 0 {
+		settings.tag = origin_tags[0]
+	}
+
+	settings.checksum = n.newChecksumFilter(name)
+	settings.stats = n.deviceStats(name)
+	log.Info(fmt.Sprintf("Player %s replaying %s at speed %g", name, settings.file_name, settings.speed))
+	n.goDevice(name, func(ctx context.Context) {
+		player(ctx, name, settings, n.deviceLogger(name), n.deviceChannels(name))
+	})
+	return nil
+}
+
+func player(ctx context.Context, name string, settings playerSettings, log *slog.Logger,
+	channels *map[string](chan string)) {
+	for {
+		pass_start := time.Now()
+		if err := playFile(ctx, name, settings, log, channels); err != nil {
+			log.Error(fmt.Sprintf("Player %s Error: %s", name, err))
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !settings.loop {
+			log.Info(fmt.Sprintf("Player %s finished %s", name, settings.file_name))
+			return
+		}
+		if wait := min_loop_pass - time.Since(pass_start); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				return
+			}
+		}
+	}
+}
+
+// Plays the file once keeping the gaps between records divided by the speed.
+// Returns an error if the file has no records so that a loop does not spin.
+func playFile(ctx context.Context, name string, settings playerSettings, log *slog.Logger,
+	channels *map[string](chan string)) error {
+	f, err := os.Open(settings.file_name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	played := 0
+	var first time.Time
+	start := time.Now()
+	for scanner.Scan() {
+		rec, err := parseCaptureRecord(scanner.Text())
+		if err != nil {
+			log.Warn(fmt.Sprintf("Player %s skipped line: %s", name, err))
+			settings.stats.parseError()
+			continue
+		}
+		if first.IsZero() {
+			first = rec.received
+		}
+		played++
+		due := start.Add(time.Duration(float64(rec.received.Sub(first)) / settings.speed))
+		if wait := time.Until(due); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				return nil
+			}
+		}
+
+		settings.stats.received(rec.sentence)
+		str, ok := settings.checksum.filter(rec.sentence)
+		if !ok {
+			continue
+		}
+		tag := rec.tag
+		if settings.tag != "" {
+			tag = settings.tag
+		}
+		if tag != "" {
+			str = fmt.Sprintf("@%s@%s", tag, str)
+		}
+		for _, out := range settings.outputs {
+			if !settings.stats.send(ctx, (*channels)[out], str) {
+				log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if played == 0 {
+		return fmt.Errorf("no records to play in %s", settings.file_name)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestRecorderWritesCapture(t *testing.T) {
+	dir := t.TempDir()
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Capture_config)
+	n.Config.Values["recorder"]["directory"] = []string{dir}
+	n.monitor_active = true
+	n.RunDevice("recorder", n.devices["recorder"])
+
+	n.Channels["to_recorder"] <- "@cp_@$HCHDM,200.5,M*2E"
+	n.Channels["to_recorder"] <- "$IIDPT,5.2,0.5*42"
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "passage_*.txt"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 capture file got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 captured lines got %d", len(lines))
+	}
+	rec, err := parseCaptureRecord(lines[0])
+	if err != nil || rec.tag != "cp_" || rec.sentence != "$HCHDM,200.5,M*2E" {
+		t.Errorf("Bad capture record %v %s", rec, err)
+	}
+	rec, err = parseCaptureRecord(lines[1])
+	if err != nil || rec.tag != "" || rec.sentence != "$IIDPT,5.2,0.5*42" {
+		t.Errorf("Bad capture record %v %s", rec, err)
+	}
+}
+
+func TestPlayerReplaysWithTiming(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "passage.txt")
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	capture := formatCaptureRecord(start, "@cp_@$HCHDM,200.5,M*2E") +
+		formatCaptureRecord(start.Add(2*time.Second), "$IIDPT,5.2,0.5*42")
+	os.WriteFile(file_name, []byte(capture), 0644)
+
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Capture_config)
+	n.Config.Values["player"]["file"] = []string{file_name}
+	n.monitor_active = true
+	began := time.Now()
+	n.RunDevice("player", n.devices["player"])
+
+	first := <-n.Channels["to_recorder"]
+	second := <-n.Channels["to_recorder"]
+	took := time.Since(began)
+	if first != "@cp_@$HCHDM,200.5,M*2E" || second != "$IIDPT,5.2,0.5*42" {
+		t.Errorf("Replayed wrong sentences <%s> <%s>", first, second)
+	}
+	// 2 seconds at speed 10
+	if took < 150*time.Millisecond || took > time.Second {
+		t.Errorf("Replay timing wrong took %s", took)
+	}
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Player player replaying " + file_name + " at speed 10",
+		"Player player finished " + file_name,
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
+
+func TestPlayerLoopEmptyFile(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "empty.txt")
+	os.WriteFile(file_name, []byte("not a capture record\n"), 0644)
+
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Capture_config)
+	n.Config.Values["player"]["file"] = []string{file_name}
+	n.Config.Values["player"]["loop"] = []string{"on"}
+	n.monitor_active = true
+	n.RunDevice("player", n.devices["player"])
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Player player Error: no records to play in " + file_name,
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	// the player stops rather than replaying the file again
+	skipped := 0
+	for _, message := range messages {
+		if strings.Contains(message, "Player player skipped line") {
+			skipped++
+		}
+	}
+	if skipped != 1 {
+		t.Errorf("Expected the file to be played once got %d skipped lines", skipped)
+	}
+	n.Shutdown(context.Background())
+}
+
+func TestPlayerLoopSingleRecord(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "single.txt")
+	capture := formatCaptureRecord(time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), "$IIDPT,5.2,0.5*42")
+	os.WriteFile(file_name, []byte(capture), 0644)
+
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Capture_config)
+	n.Config.Values["player"]["file"] = []string{file_name}
+	n.Config.Values["player"]["loop"] = []string{"on"}
+	n.monitor_active = true
+	n.RunDevice("player", n.devices["player"])
+	time.Sleep(300 * time.Millisecond)
+
+	// the file spans no time so the next pass waits rather than filling the channel
+	if played := len(n.Channels["to_recorder"]); played != 1 {
+		t.Errorf("Expected the record to be played once in 300ms got %d", played)
+	}
+	n.Shutdown(context.Background())
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a device does when the channel it is sending to is full
+const (
+	policy_drop_newest        = "drop_newest"        // drops the sentence being sent, the default
+	policy_drop_oldest        = "drop_oldest"        // drops the sentence waiting longest to make room
+	policy_block              = "block"              // waits until there is room
+	policy_block_with_timeout = "block_with_timeout" // waits up to the timeout then drops the sentence
+)
+
+var channel_policies = []string{policy_drop_newest, policy_drop_oldest, policy_block, policy_block_with_timeout}
+
+const (
+	default_channel_capacity = 30
+	default_channel_timeout  = time.Second
+)
+
+// The settings of a channel section in the config eg
+//
+//	to_autohelm:
+//	    type: channel
+//	    capacity: 10
+//	    policy: block_with_timeout
+//	    timeout: 500    # ms
+type channelPolicy struct {
+	capacity int
+	policy   string
+	timeout  time.Duration
+}
+
+// The policy and drop count of each channel keyed by the go channel so
+// that a device can look them up from the channel it is sending to
+type channelPolicies struct {
+	mu         sync.Mutex
+	by_channel map[chan string](*channelState)
+}
+
+type channelState struct {
+	name    string
+	policy  channelPolicy
+	dropped atomic.Int64
+}
+
+func defaultChannelPolicy() channelPolicy {
+	return channelPolicy{capacity: default_channel_capacity, policy: policy_drop_newest, timeout: default_channel_timeout}
+}
+
+// Parses the settings of a channel section returning the policy and any
+// errors separated by ";"
+func parseChannelPolicy(config map[string][]string) (channelPolicy, string) {
+	policy := defaultChannelPolicy()
+	error_str := ""
+	if capacities, found := config["capacity"]; found && len(capacities) > 0 {
+		if capacity, err := strconv.Atoi(capacities[0]); err == nil && capacity > 0 {
+			policy.capacity = capacity
+		} else {
+			error_str += fmt.Sprintf("capacity %s must be a number greater than 0;", capacities[0])
+		}
+	}
+	if policies, found := config["policy"]; found && len(policies) > 0 {
+		if slices.Contains(channel_policies, policies[0]) {
+			policy.policy = policies[0]
+		} else {
+			error_str += fmt.Sprintf("policy %s must be one of %s;", policies[0], strings.Join(channel_policies, ", "))
+		}
+	}
+	if timeouts, found := config["timeout"]; found && len(timeouts) > 0 {
+		if timeout, err := strconv.Atoi(timeouts[0]); err == nil && timeout > 0 {
+			policy.timeout = time.Duration(timeout) * time.Millisecond
+		} else {
+			error_str += fmt.Sprintf("timeout %s must be a number of ms greater than 0;", timeouts[0])
+		}
+		if policy.policy != policy_block_with_timeout {
+			error_str += "timeout is only used by the block_with_timeout policy;"
+		}
+	}
+	return policy, error_str
+}
+
+// Returns the policy of the named channel, set by a channel section of
+// the same name, or the default
+func (n *NmeaMux) channelPolicy(channel string) channelPolicy {
+	if values, found := n.Config.Values[channel]; found && configType(values) == "channel" {
+		policy, _ := parseChannelPolicy(values)
+		return policy
+	}
+	return defaultChannelPolicy()
+}
+
+// Sets the policy of a channel keeping its drop count
+func (c *channelPolicies) set(channel chan string, name string, policy channelPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, found := c.by_channel[channel]; found {
+		state.policy = policy
+		return
+	}
+	c.by_channel[channel] = &channelState{name: name, policy: policy}
+}
+
+// Makes alias share the policy and drop count of channel eg for a tap
+func (c *channelPolicies) share(alias chan string, channel chan string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, found := c.by_channel[channel]; found {
+		c.by_channel[alias] = state
+	}
+}
+
+func (c *channelPolicies) lookup(channel chan string) (channelPolicy, *channelState) {
+	if c == nil {
+		return defaultChannelPolicy(), nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, found := c.by_channel[channel]
+	if !found {
+		return defaultChannelPolicy(), nil
+	}
+	return state.policy, state
+}
+
+// Returns the sentences dropped from each channel by name
+func (c *channelPolicies) dropped() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := make(map[string]int64, len(c.by_channel))
+	for _, state := range c.by_channel {
+		dropped[state.name] = state.dropped.Load()
+	}
+	return dropped
+}
+
+// Puts str on channel following the channel's policy when it is full.
+// Returns false if str was dropped. Blocking policies give up when ctx
+// is done so that devices can be stopped.
+func (c *channelPolicies) send(ctx context.Context, channel chan string, str string) bool {
+	select {
+	case channel <- str:
+		return true
+	default:
+	}
+
+	policy, state := c.lookup(channel)
+	switch policy.policy {
+	case policy_drop_oldest:
+		for {
+			select {
+			case <-channel:
+				state.drop()
+			default:
+			}
+			select {
+			case channel <- str:
+				return true
+			default:
+			}
+		}
+	case policy_block:
+		select {
+		case channel <- str:
+			return true
+		case <-ctx.Done():
+		}
+	case policy_block_with_timeout:
+		timer := time.NewTimer(policy.timeout)
+		defer timer.Stop()
+		select {
+		case channel <- str:
+			return true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	state.drop()
+	return false
+}
+
+func (s *channelState) drop() {
+	if s != nil {
+		s.dropped.Add(1)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestChannelConfig(t *testing.T) {
+	n := NewMux()
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Channel_config); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	if cap(n.Channels["to_ais"]) != 3 || cap(n.Channels["to_autohelm"]) != 2 {
+		t.Errorf("Expected capacities 3 and 2 got %d and %d", cap(n.Channels["to_ais"]), cap(n.Channels["to_autohelm"]))
+	}
+	policy, _ := n.policies.lookup(n.Channels["to_autohelm"])
+	if policy.policy != policy_block_with_timeout || policy.timeout != 50*time.Millisecond {
+		t.Errorf("Expected block with 50ms timeout got %+v", policy)
+	}
+	for _, d := range n.Graph().Devices {
+		if d.Type == "channel" {
+			t.Errorf("Channel section %s should not be a device in the graph", d.Name)
+		}
+	}
+}
+
+func TestChannelConfigErrors(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Bad_channel_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	expected := []string{
+		"to_ais: capacity 0 must be a number greater than 0",
+		"to_ais: policy shed must be one of drop_newest, drop_oldest, block, block_with_timeout",
+		"to_ais: timeout is only used by the block_with_timeout policy",
+		"to_nowhere type: channel to_nowhere is not the input or an output of any device - name the section after the channel it sets",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Config. Expected %d errors got %s", len(expected), err)
+	}
+	for i := range expected {
+		if errs[i].Error() != expected[i] {
+			t.Errorf("Config. Expected %s got %s", expected[i], errs[i])
+		}
+	}
+}
+
+func TestChannelDropOldest(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Channel_config)
+	stats := n.deviceStats("ais_listen")
+	for _, str := range []string{"!AIVDM,1", "!AIVDM,2", "!AIVDM,3", "!AIVDM,4", "!AIVDM,5"} {
+		if !stats.send(context.Background(), n.Channels["to_ais"], str) {
+			t.Errorf("Expected %s to be sent", str)
+		}
+	}
+	received := test_helpers.GetMessages(n.Channels["to_ais"])
+	if len(received) != 3 || received[0] != "!AIVDM,3" || received[2] != "!AIVDM,5" {
+		t.Errorf("Expected the newest 3 sentences got %s", received)
+	}
+	s := n.Stats()
+	if s.Channels["to_ais"].Dropped != 2 || s.Devices["ais_listen"].Dropped != 0 || s.Devices["ais_listen"].SentencesOut != 5 {
+		t.Errorf("Expected 2 dropped from the channel got %+v %+v", s.Channels["to_ais"], s.Devices["ais_listen"])
+	}
+}
+
+func TestChannelBlockWithTimeout(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Channel_config)
+	stats := n.deviceStats("ais_listen")
+	out := n.Channels["to_autohelm"]
+	stats.send(context.Background(), out, "$GPAPB,1")
+	stats.send(context.Background(), out, "$GPAPB,2")
+
+	start := time.Now()
+	if stats.send(context.Background(), out, "$GPAPB,3") {
+		t.Error("Expected the send to time out on a full channel")
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected the send to wait for the timeout but it waited %s", waited)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-out
+	}()
+	if !stats.send(context.Background(), out, "$GPAPB,4") {
+		t.Error("Expected the send to wait until the channel had room")
+	}
+	s := n.Stats()
+	if s.Channels["to_autohelm"].Dropped != 1 || s.Devices["ais_listen"].Dropped != 1 {
+		t.Errorf("Expected 1 dropped got %+v %+v", s.Channels["to_autohelm"], s.Devices["ais_listen"])
+	}
+}
+
+func TestChannelBlock(t *testing.T) {
+	policies := &channelPolicies{by_channel: make(map[chan string](*channelState))}
+	out := make(chan string, 1)
+	policies.set(out, "to_autohelm", channelPolicy{capacity: 1, policy: policy_block})
+	out <- "$GPAPB,1"
+
+	sent := make(chan bool)
+	go func() { sent <- policies.send(context.Background(), out, "$GPAPB,2") }()
+	select {
+	case <-sent:
+		t.Fatal("Expected the send to block on a full channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-out
+	if !<-sent || <-out != "$GPAPB,2" {
+		t.Error("Expected the sentence to be sent once there was room")
+	}
+
+	out <- "$GPAPB,3"
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { sent <- policies.send(ctx, out, "$GPAPB,4") }()
+	cancel()
+	if <-sent {
+		t.Error("Expected a blocked send to give up when the device is stopped")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Drops sentences identical to one already seen within the window, as happens
+// when the same instrument data arrives by two routes
+type dedup struct {
+	window        time.Duration
+	ignore_talker bool
+	seen          map[string]time.Time
+}
+
+func newDedup(window time.Duration, ignore_talker bool) *dedup {
+	return &dedup{
+		window:        window,
+		ignore_talker: ignore_talker,
+		seen:          make(map[string]time.Time),
+	}
+}
+
+// Returns the key used to compare sentences ignoring the origin tag and the
+// checksum and, if configured, the talker ID
+func (d *dedup) key(str string) string {
+	_, sentence := trim_tag(str)
+	if star := strings.LastIndexByte(sentence, '*'); star > 0 {
+		sentence = sentence[:star]
+	}
+	if d.ignore_talker {
+		talker, sentence_type := sentenceAddress(sentence)
+		if talker != "" && talker != "P" {
+			sentence = sentence[:1] + sentence_type + sentence[1+len(talker)+len(sentence_type):]
+		}
+	}
+	return sentence
+}
+
+// Returns true if the sentence is a duplicate and must be dropped
+func (d *dedup) duplicate(str string, now time.Time) bool {
+	key := d.key(str)
+	if last, found := d.seen[key]; found && now.Sub(last) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// Forgets sentences seen before the window
+func (d *dedup) purge(now time.Time) {
+	for key, last := range d.seen {
+		if now.Sub(last) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+func (n *NmeaMux) dedupProcess(name string) error {
+	// forwards sentences from the input channel to the outputs dropping duplicates
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	error_str := ""
+
+	input := ""
+	if inputs, found := config["input"]; found && len(inputs) == 1 {
+		input = inputs[0]
+	} else {
+		error_str += "Invalid number of input settings must be exactly 1;"
+	}
+
+	window := time.Second
+	if windows, found := config["window"]; found {
+		if ms, err := strconv.Atoi(windows[0]); err == nil && ms > 0 {
+			window = time.Duration(ms) * time.Millisecond
+		} else {
+			error_str += "window must be a number of milliseconds greater than 0;"
+		}
+	}
+
+	ignore_talker := false
+	if ignores, found := config["ignore_talker"]; found && len(ignores) > 0 && ignores[0] == "on" {
+		ignore_talker = true
+	}
+
+	report := slices.Contains(config["report"], "on")
+
+	if len(error_str) > 0 {
+		log.Error(fmt.Sprintf("Dedup <%s> Errors: %s", name, error_str))
+		return fmt.Errorf("dedup %s has these errors:%s", name, error_str)
+	}
+
+	outputs := config["outputs"]
+	log.Info(fmt.Sprintf("Started dedup %s on %s window %s", name, input, window))
+	n.goDevice(name, func(ctx context.Context) {
+		deduplicator(ctx, name, newDedup(window, ignore_talker), input, outputs, n.deviceStats(name), n.deviceLogger(name), n.deviceChannels(name), report)
+	})
+	return nil
+}
+
+func deduplicator(ctx context.Context, name string, d *dedup, input string, outputs []string, stats *deviceStats, log *slog.Logger,
+	channels *map[string](chan string), report bool) {
+	purge_ticker := time.NewTicker(d.window)
+	defer purge_ticker.Stop()
+	report_ticker := time.NewTicker(time.Minute)
+	defer report_ticker.Stop()
+	reported := int64(0)
+
+	for {
+		select {
+		case str := <-(*channels)[input]:
+			stats.received(str)
+			if d.duplicate(str, time.Now()) {
+				stats.duplicate()
+				continue
+			}
+			for _, out := range outputs {
+				if !stats.send(ctx, (*channels)[out], str) {
+					log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+				}
+			}
+		case now := <-purge_ticker.C:
+			d.purge(now)
+		case <-report_ticker.C:
+			if suppressed := stats.duplicates.Load(); report && suppressed != reported {
+				log.Debug(fmt.Sprintf("Dedup %s has suppressed %d duplicate sentences", name, suppressed), "category", category_device)
+				reported = suppressed
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
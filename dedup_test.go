@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestDedupWindow(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	d := newDedup(time.Second, false)
+	if d.duplicate("@ray_@$IIDPT,5.2,0.5*42", start) {
+		t.Error("First sentence is not a duplicate")
+	}
+	if !d.duplicate("$IIDPT,5.2,0.5*42", start.Add(100*time.Millisecond)) {
+		t.Error("Same sentence from another source within window is a duplicate")
+	}
+	if d.duplicate("$SDDPT,5.2,0.5*5E", start.Add(200*time.Millisecond)) {
+		t.Error("Talker differs and is not ignored")
+	}
+	if d.duplicate("$IIDPT,5.2,0.5*42", start.Add(1100*time.Millisecond)) {
+		t.Error("Sentence after window is not a duplicate")
+	}
+}
+
+func TestDedupIgnoreTalker(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	d := newDedup(time.Second, true)
+	d.duplicate("$IIDPT,5.2,0.5*42", start)
+	if !d.duplicate("$SDDPT,5.2,0.5*5E", start) {
+		t.Error("Talker is ignored so this is a duplicate")
+	}
+	if d.duplicate("$SDDPT,5.3,0.5*5F", start) {
+		t.Error("Different data is not a duplicate")
+	}
+	d.purge(start.Add(time.Second))
+	if len(d.seen) != 0 {
+		t.Errorf("Expected all purged got %d", len(d.seen))
+	}
+}
+
+func TestDedupDevice(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Dedup_config)
+	n.monitor_active = true
+	if err := n.RunDevice("opencpn_dedup", n.devices["opencpn_dedup"]); err != nil {
+		t.Errorf("Dedup failed to start %s", err)
+	}
+	n.Channels["to_dedup"] <- "@ray_@$IIDPT,5.2,0.5*42"
+	n.Channels["to_dedup"] <- "$SDDPT,5.2,0.5*5E"
+	n.Channels["to_dedup"] <- "!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26"
+	n.Channels["to_dedup"] <- "!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26"
+
+	received := test_helpers.GetMessages(n.Channels["to_udp_opencpn"])
+	if len(received) != 2 || received[0] != "@ray_@$IIDPT,5.2,0.5*42" || received[1][0] != '!' {
+		t.Errorf("Expected duplicates removed got %s", received)
+	}
+	if duplicates := n.Stats().Devices["opencpn_dedup"].Duplicates; duplicates != 2 {
+		t.Errorf("Expected 2 duplicates counted got %d", duplicates)
+	}
+}
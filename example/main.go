@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
 	"github.com/martinmarsh/nmea-mux"
-	
+	"os"
+	"os/signal"
+	"syscall"
+
 	"fmt"
 )
 
 func main() {
 	n := nmea_mux.NewMux()
 
+	// stop cleanly on Ctrl-C or when the system powers down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// for default config.yaml in current folder
 	// optional parameters define folder, filename, format, "config as a string
 	if err := n.LoadConfig(); err == nil {
-		n.Run()        // Run the virtual devices / go tasks
-		n.WaitToStop() // Wait for ever?
+		n.RunContext(ctx) // Run the virtual devices / go tasks until signalled
+		n.WaitToStop()    // Wait until stopped then close ports and flush logs
 		
 	}else{
 		fmt.Println(err)
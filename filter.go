@@ -0,0 +1,203 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A filter rule is written as kind:value where kind is talker, sentence, tag or
+// regex eg "sentence:RMC" or "regex:^!AIVD". A rule without a kind, eg "!AIVDM",
+// matches sentences which start with it.
+type filterRule struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+}
+
+type filterRoute struct {
+	name    string
+	include []filterRule
+	exclude []filterRule
+	outputs []string
+}
+
+func parseFilterRule(rule string) (filterRule, error) {
+	f := filterRule{kind: "start", value: strings.TrimSpace(rule)}
+	if kind, value, found := strings.Cut(f.value, ":"); found {
+		f.kind = strings.ToLower(strings.TrimSpace(kind))
+		f.value = strings.TrimSpace(value)
+	}
+	switch f.kind {
+	case "talker", "sentence":
+		f.value = strings.ToUpper(f.value)
+	case "tag", "start":
+	case "regex":
+		re, err := regexp.Compile(f.value)
+		if err != nil {
+			return f, fmt.Errorf("bad regex <%s>: %s", f.value, err)
+		}
+		f.re = re
+	default:
+		return f, fmt.Errorf("unknown rule kind <%s> must be talker, sentence, tag or regex", f.kind)
+	}
+	if f.value == "" {
+		return f, fmt.Errorf("rule <%s> has no value", rule)
+	}
+	return f, nil
+}
+
+func (f *filterRule) match(tag string, str string, talker string, sentence_type string) bool {
+	switch f.kind {
+	case "talker":
+		return talker == f.value
+	case "sentence":
+		return sentence_type == f.value
+	case "tag":
+		return tag == f.value
+	case "regex":
+		return f.re.MatchString(str)
+	default:
+		return strings.HasPrefix(str, f.value)
+	}
+}
+
+// A route accepts a sentence if it matches any include rule, or there are none,
+// and does not match any exclude rule
+func (r *filterRoute) accepts(tag string, str string) bool {
+	talker, sentence_type := sentenceAddress(str)
+	accept := len(r.include) == 0
+	for i := range r.include {
+		if r.include[i].match(tag, str, talker, sentence_type) {
+			accept = true
+			break
+		}
+	}
+	if accept {
+		for i := range r.exclude {
+			if r.exclude[i].match(tag, str, talker, sentence_type) {
+				return false
+			}
+		}
+	}
+	return accept
+}
+
+// Finds routes in config keys of the form routes.<route name>.<include|exclude|outputs>
+func parseFilterRoutes(config map[string][]string) ([]*filterRoute, string) {
+	error_str := ""
+	by_name := make(map[string]*filterRoute)
+	for key, values := range config {
+		parts := strings.Split(key, ".")
+		if parts[0] != "routes" {
+			continue
+		}
+		if len(parts) != 3 {
+			error_str += fmt.Sprintf("route setting %s must be routes.<name>.<include, exclude or outputs>;", key)
+			continue
+		}
+		route, found := by_name[parts[1]]
+		if !found {
+			route = &filterRoute{name: parts[1]}
+			by_name[parts[1]] = route
+		}
+		switch parts[2] {
+		case "outputs":
+			route.outputs = values
+		case "include", "exclude":
+			for _, v := range values {
+				rule, err := parseFilterRule(v)
+				if err != nil {
+					error_str += fmt.Sprintf("route %s %s %s;", route.name, parts[2], err)
+					continue
+				}
+				if parts[2] == "include" {
+					route.include = append(route.include, rule)
+				} else {
+					route.exclude = append(route.exclude, rule)
+				}
+			}
+		default:
+			error_str += fmt.Sprintf("route %s has unknown setting %s;", route.name, parts[2])
+		}
+	}
+
+	routes := make([]*filterRoute, 0, len(by_name))
+	for _, route := range by_name {
+		if len(route.outputs) == 0 {
+			error_str += fmt.Sprintf("route %s has no outputs;", route.name)
+		}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].name < routes[j].name })
+	return routes, error_str
+}
+
+func (n *NmeaMux) filterProcess(name string) error {
+	// routes each sentence on the input channel to the outputs of every route which accepts it
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	error_str := ""
+
+	input := ""
+	if inputs, found := config["input"]; found && len(inputs) == 1 {
+		input = inputs[0]
+	} else {
+		error_str += "Invalid number of input settings must be exactly 1;"
+	}
+
+	routes, route_errors := parseFilterRoutes(config)
+	error_str += route_errors
+	if len(routes) == 0 {
+		error_str += "No routes defined;"
+	}
+
+	report := slices.Contains(config["report"], "on")
+
+	if len(error_str) > 0 {
+		log.Error(fmt.Sprintf("Filter <%s> Errors: %s", name, error_str))
+		return fmt.Errorf("filter %s has these errors:%s", name, error_str)
+	}
+
+	log.Info(fmt.Sprintf("Started filter %s on %s with %d routes", name, input, len(routes)))
+	n.goDevice(name, func(ctx context.Context) {
+		filterRouter(ctx, name, routes, input, n.deviceStats(name), n.deviceLogger(name), n.deviceChannels(name), report)
+	})
+	return nil
+}
+
+func filterRouter(ctx context.Context, name string, routes []*filterRoute, input string, stats *deviceStats, log *slog.Logger,
+	channels *map[string](chan string), report bool) {
+	for {
+		var str string
+		select {
+		case str = <-(*channels)[input]:
+		case <-ctx.Done():
+			return
+		}
+		stats.received(str)
+		tag, sentence := trim_tag(str)
+		for _, route := range routes {
+			if !route.accepts(tag, sentence) {
+				continue
+			}
+			if report {
+				log.Debug(fmt.Sprintf("Filter %s route %s:  %s", name, route.name, str), "category", category_device)
+			}
+			for _, out := range route.outputs {
+				if !stats.send(ctx, (*channels)[out], str) {
+					log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestFilterConfigWiring(t *testing.T) {
+	n := NewMux()
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Filter_config); err != nil {
+		t.Errorf("Config. Failed to Load err: %s", err)
+	}
+	for _, channel := range []string{"to_vhf", "to_autohelm", "to_log"} {
+		if len(n.Config.OutChannelList[channel]) != 1 || n.Config.OutChannelList[channel][0] != "router" {
+			t.Errorf("Route output %s not wired to router got %s", channel, n.Config.OutChannelList[channel])
+		}
+	}
+}
+
+func TestFilterRoutes(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Filter_config)
+	n.monitor_active = true
+	if err := n.RunDevice("router", n.devices["router"]); err != nil {
+		t.Errorf("Filter failed to start %s", err)
+	}
+
+	sentences := []string{
+		"!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26",
+		"@ray_@$GPRMC,092750.000,A,5321.6802,N,00630.3372,W,0.02,31.66,280511,,,A*43",
+		"$IIHDM,200.5,M*34",
+		"$HCHDM,200.5,M*2E",
+		"$SDDPT,5.2,0.5*5E",
+	}
+	for _, s := range sentences {
+		n.Channels["to_router"] <- s
+	}
+
+	vhf := test_helpers.GetMessages(n.Channels["to_vhf"])
+	if len(vhf) != 1 || vhf[0] != sentences[0] {
+		t.Errorf("vhf route got %s", vhf)
+	}
+	autohelm := test_helpers.GetMessages(n.Channels["to_autohelm"])
+	if len(autohelm) != 2 || autohelm[0] != sentences[1] || autohelm[1] != sentences[3] {
+		t.Errorf("autopilot route got %s", autohelm)
+	}
+	log := test_helpers.GetMessages(n.Channels["to_log"])
+	if len(log) != 2 || log[0] != sentences[1] || log[1] != sentences[4] {
+		t.Errorf("log route got %s", log)
+	}
+}
+
+func TestFilterBadRule(t *testing.T) {
+	if _, err := parseFilterRule("colour:red"); err == nil {
+		t.Error("Expected error for unknown rule kind")
+	}
+	if _, err := parseFilterRule("regex:[a-"); err == nil {
+		t.Error("Expected error for bad regex")
+	}
+	rule, err := parseFilterRule("sentence:rmc")
+	if err != nil || rule.kind != "sentence" || rule.value != "RMC" {
+		t.Errorf("Bad rule parse %v %s", rule, err)
+	}
+}
+
+func TestSentenceAddress(t *testing.T) {
+	tests := [][3]string{
+		{"$GPRMC,092750.000,A", "GP", "RMC"},
+		{"!AIVDM,1,1,,A", "AI", "VDM"},
+		{"$PGRMZ,246,f,3*1B", "P", "GRMZ"},
+		{"$HCHDM*2E", "HC", "HDM"},
+		{"garbage", "", ""},
+	}
+	for _, test := range tests {
+		talker, sentence_type := sentenceAddress(test[0])
+		if talker != test[1] || sentence_type != test[2] {
+			t.Errorf("sentenceAddress(%s) got %s %s", test[0], talker, sentence_type)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"errors"
+)
+
+// Longest line kept by the readers, NMEA 0183 allows 82 bytes with the CR LF
+// but some instruments send longer proprietary sentences
+const max_line_len = 92
+
+var (
+	errOversizeLine = errors.New("line too long - discarded")
+	errPartialLine  = errors.New("partial line discarded at the start of a new sentence")
+	errNoise        = errors.New("bytes outside a sentence discarded")
+)
+
+// Splits the bytes read by a device into sentences ended by CR, LF or CRLF.
+// A sentence starts with $ or ! and other bytes are discarded until one
+// arrives. A $ or ! always starts a new sentence so that a line broken by
+// noise or a reopened port does not corrupt the next one. Lines are framed
+// in a fixed buffer so no memory is allocated per byte or per line.
+type lineFramer struct {
+	line     []byte // the line being framed, never grows past its capacity
+	input    []byte // bytes written but not yet framed
+	ready    bool   // line was returned by next and is cleared on the next call
+	discard  bool   // skipping the rest of an oversize line
+	in_noise bool   // discarding bytes until a sentence starts
+	oversize int    // lines discarded for being too long
+	partial  int    // lines discarded when a new sentence started
+	noise    int    // bytes discarded outside a sentence
+}
+
+func newLineFramer(max_len int) *lineFramer {
+	return &lineFramer{line: make([]byte, 0, max_len)}
+}
+
+// Adds bytes to be framed. p is not copied so next must be called until it
+// returns no line and no error before p is reused.
+func (f *lineFramer) write(p []byte) {
+	f.input = p
+}
+
+// Returns the next sentence without its end of line, or nil once the bytes
+// written are used up. The line is only valid until the next call. An
+// error is returned for each line or run of noise discarded and framing
+// continues on the next call.
+func (f *lineFramer) next() ([]byte, error) {
+	if f.ready {
+		f.line = f.line[:0]
+		f.ready = false
+	}
+	for len(f.input) > 0 {
+		b := f.input[0]
+		f.input = f.input[1:]
+		switch {
+		case b == '$' || b == '!':
+			partial := len(f.line) > 0
+			noise := f.in_noise
+			f.discard = false
+			f.in_noise = false
+			f.line = append(f.line[:0], b)
+			if partial {
+				f.partial++
+				return nil, errPartialLine
+			}
+			if noise {
+				return nil, errNoise
+			}
+		case b == '\r' || b == '\n':
+			if len(f.line) > 0 {
+				f.ready = true
+				return f.line, nil
+			}
+			f.discard = false
+			if f.in_noise {
+				f.in_noise = false
+				return nil, errNoise
+			}
+		case f.discard:
+		case len(f.line) == 0:
+			f.noise++
+			f.in_noise = true
+		case len(f.line) == cap(f.line):
+			f.line = f.line[:0]
+			f.discard = true
+			f.oversize++
+			return nil, errOversizeLine
+		default:
+			f.line = append(f.line, b)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Frames data written in chunks of up to size bytes returning the lines
+// and the errors in the order they were found
+func frameLines(f *lineFramer, data []byte, size int) []string {
+	lines := make([]string, 0)
+	for start := 0; start < len(data); start += size {
+		f.write(data[start:min(start+size, len(data))])
+		for {
+			line, err := f.next()
+			if err != nil {
+				lines = append(lines, "error: "+err.Error())
+				continue
+			}
+			if line == nil {
+				break
+			}
+			lines = append(lines, string(line))
+		}
+	}
+	return lines
+}
+
+func TestLineFramer(t *testing.T) {
+	long := "$GPXTE," + strings.Repeat("9", 100)
+	tests := []struct {
+		name     string
+		data     string
+		expected []string
+	}{
+		{"CR", "$HCHDM,200.5,M*2E\r$GPXTE,A\r", []string{"$HCHDM,200.5,M*2E", "$GPXTE,A"}},
+		{"LF", "$HCHDM,200.5,M*2E\n$GPXTE,A\n", []string{"$HCHDM,200.5,M*2E", "$GPXTE,A"}},
+		{"CRLF", "$HCHDM,200.5,M*2E\r\n$GPXTE,A\r\n", []string{"$HCHDM,200.5,M*2E", "$GPXTE,A"}},
+		{"blank lines", "\r\n\r\n$GPXTE,A\n\r\n", []string{"$GPXTE,A"}},
+		{"not nmea", "Message 1\r\nMessage 2\r\n", []string{"error: " + errNoise.Error(), "error: " + errNoise.Error()}},
+		{"noise between sentences", "$GPXTE,A\r\n\x00\x13junk\r\n$GPXTE,B\r\n",
+			[]string{"$GPXTE,A", "error: " + errNoise.Error(), "$GPXTE,B"}},
+		{"resync", "$HCHD$GPXTE,A\r\n!AIVDM,1\r\n", []string{"error: " + errPartialLine.Error(), "$GPXTE,A", "!AIVDM,1"}},
+		{"noise before start", "\x92\xf3$GPXTE,A\r\n", []string{"error: " + errNoise.Error(), "$GPXTE,A"}},
+		{"oversize", long + "\r\n$GPXTE,A\r\n", []string{"error: " + errOversizeLine.Error(), "$GPXTE,A"}},
+		{"oversize resync", long + "$GPXTE,A\r\n", []string{"error: " + errOversizeLine.Error(), "$GPXTE,A"}},
+		{"no end", "$GPXTE,A\r\n$HCHDM,2", []string{"$GPXTE,A"}},
+	}
+	for _, test := range tests {
+		for _, size := range []int{1, 3, 25, len(test.data)} {
+			lines := frameLines(newLineFramer(max_line_len), []byte(test.data), size)
+			if !slices.Equal(lines, test.expected) {
+				t.Errorf("%s in chunks of %d got %q expected %q", test.name, size, lines, test.expected)
+			}
+		}
+	}
+}
+
+func TestLineFramerCounts(t *testing.T) {
+	f := newLineFramer(max_line_len)
+	frameLines(f, []byte("$HCHD$GPXTE,A\r\n$GPXTE,"+strings.Repeat("9", 100)+"\r\njunk\r\n"), 7)
+	if f.partial != 1 || f.oversize != 1 || f.noise != 4 {
+		t.Errorf("Expected 1 partial and 1 oversize line and 4 noise bytes got %d, %d and %d",
+			f.partial, f.oversize, f.noise)
+	}
+}
+
+func TestLineFramerKeepsPartLine(t *testing.T) {
+	f := newLineFramer(max_line_len)
+	lines := frameLines(f, []byte("$HCHDM,20"), 25)
+	lines = append(lines, frameLines(f, []byte("0.5,M*2E\r\n"), 25)...)
+	if !slices.Equal(lines, []string{"$HCHDM,200.5,M*2E"}) {
+		t.Errorf("Expected the line split across reads to be joined got %q", lines)
+	}
+}
+
+func TestLineFramerAllocations(t *testing.T) {
+	f := newLineFramer(max_line_len)
+	data := []byte("$HCHDM,200.5,M*2E\r\n$HCHD$GPXTE,A\n!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26\r\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		f.write(data)
+		for {
+			line, err := f.next()
+			if line == nil && err == nil {
+				break
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected framing not to allocate got %.1f allocations per run", allocs)
+	}
+}
+
+func FuzzLineFramer(f *testing.F) {
+	f.Add([]byte("$HCHDM,200.5,M*2E\r\n!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26\r\n"), uint8(5))
+	f.Add([]byte("$HCHD$GPXTE,A\r\r\n\n$GPXTE,A"), uint8(1))
+	f.Add([]byte("$GPXTE,"+strings.Repeat("9", 100)+"\r\n"), uint8(40))
+	f.Add([]byte("\x00\xff$\r!\n"), uint8(0))
+	f.Fuzz(func(t *testing.T, data []byte, size uint8) {
+		whole := frameLines(newLineFramer(max_line_len), data, max(len(data), 1))
+		chunked := frameLines(newLineFramer(max_line_len), data, int(size%32)+1)
+		if !slices.Equal(whole, chunked) {
+			t.Fatalf("Framing depends on the read size got %q and %q", whole, chunked)
+		}
+		for _, line := range whole {
+			if strings.HasPrefix(line, "error: ") {
+				continue
+			}
+			if len(line) == 0 || len(line) > max_line_len {
+				t.Fatalf("Line length %d out of range %q", len(line), line)
+			}
+			if line[0] != '$' && line[0] != '!' {
+				t.Fatalf("Line does not start a sentence %q", line)
+			}
+			if bytes.ContainsAny([]byte(line), "\r\n") {
+				t.Fatalf("Line contains an end of line %q", line)
+			}
+			if strings.ContainsAny(line[1:], "$!") {
+				t.Fatalf("Line contains a sentence start after the first byte %q", line)
+			}
+		}
+	})
+}
+
+func TestLineFramerErrors(t *testing.T) {
+	f := newLineFramer(4)
+	f.write([]byte("$GPXTE\r\n"))
+	if _, err := f.next(); !errors.Is(err, errOversizeLine) {
+		t.Errorf("Expected oversize error got %v", err)
+	}
+	if line, err := f.next(); line != nil || err != nil {
+		t.Errorf("Expected the rest of the oversize line to be discarded got %q %v", line, err)
+	}
+}
@@ -5,13 +5,13 @@ go 1.21.6
 require github.com/spf13/viper v1.18.2 // direct
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/martinmarsh/nmea0183 v1.0.1
 	go.bug.st/serial v1.6.1
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The devices in the config and the channels joining them
+type Graph struct {
+	Devices []GraphDevice `json:"devices"`
+	Links   []GraphLink   `json:"links"`
+}
+
+type GraphDevice struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	OriginTag string `json:"origin_tag,omitempty"`
+	Processor string `json:"processor,omitempty"` // set for make_sentence
+}
+
+// A link is a channel from one device to another or from a processor to
+// one of its make sentences. From or To is empty if the channel is dangling,
+// ie nothing writes to it or nothing reads it.
+type GraphLink struct {
+	Channel  string `json:"channel,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Kind     string `json:"kind"` // channel or make_sentence
+	Dangling bool   `json:"dangling,omitempty"`
+}
+
+// Returns the device graph of the loaded config
+func (n *NmeaMux) Graph() Graph {
+	g := Graph{Devices: make([]GraphDevice, 0), Links: make([]GraphLink, 0)}
+	config := n.Config
+
+	for name, values := range config.Values {
+		d := GraphDevice{Name: name, Type: configType(values)}
+		if d.Type == "channel" {
+			// sets the policy of the channel of the same name, not a device
+			continue
+		}
+		if tags := values["origin_tag"]; len(tags) > 0 {
+			d.OriginTag = tags[0]
+		}
+		if d.Type == "make_sentence" {
+			if processor, found := makeSentenceProcessor(values); found {
+				d.Processor = processor
+				g.Links = append(g.Links, GraphLink{From: d.Processor, To: name, Kind: "make_sentence"})
+			}
+		}
+		g.Devices = append(g.Devices, d)
+	}
+
+	channels := make(map[string]bool)
+	for channel := range config.InChannelList {
+		channels[channel] = true
+	}
+	for channel := range config.OutChannelList {
+		channels[channel] = true
+	}
+	for channel := range channels {
+		writers := uniqueNames(config.OutChannelList[channel])
+		readers := uniqueNames(config.InChannelList[channel])
+		switch {
+		case len(writers) == 0:
+			for _, reader := range readers {
+				g.Links = append(g.Links, GraphLink{Channel: channel, To: reader, Kind: "channel", Dangling: true})
+			}
+		case len(readers) == 0:
+			for _, writer := range writers {
+				g.Links = append(g.Links, GraphLink{Channel: channel, From: writer, Kind: "channel", Dangling: true})
+			}
+		default:
+			for _, writer := range writers {
+				for _, reader := range readers {
+					g.Links = append(g.Links, GraphLink{Channel: channel, From: writer, To: reader, Kind: "channel"})
+				}
+			}
+		}
+	}
+
+	sort.Slice(g.Devices, func(i, j int) bool { return g.Devices[i].Name < g.Devices[j].Name })
+	sort.Slice(g.Links, func(i, j int) bool {
+		a, b := g.Links[i], g.Links[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Channel < b.Channel
+	})
+	return g
+}
+
+// Returns the device graph as json
+func (n *NmeaMux) GraphJSON() ([]byte, error) {
+	return json.MarshalIndent(n.Graph(), "", "  ")
+}
+
+// Returns the device graph in Graphviz DOT format eg to view with
+// dot -Tsvg graph.dot > graph.svg. Dangling channels are shown in red.
+func (n *NmeaMux) GraphDOT() string {
+	g := n.Graph()
+	var b strings.Builder
+	b.WriteString("digraph nmea_mux {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, d := range g.Devices {
+		label := fmt.Sprintf("%s\n%s", d.Name, d.Type)
+		if d.OriginTag != "" {
+			label += fmt.Sprintf("\ntag %s", d.OriginTag)
+		}
+		shape := ""
+		if d.Type == "make_sentence" {
+			shape = ", shape=note"
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q%s];\n", d.Name, label, shape)
+	}
+	for _, l := range g.Links {
+		switch {
+		case l.Kind == "make_sentence":
+			fmt.Fprintf(&b, "\t%q -> %q [label=\"make_sentence\", style=dashed];\n", l.From, l.To)
+		case l.From == "":
+			node := "unwritten_" + l.Channel
+			fmt.Fprintf(&b, "\t%q [label=%q, shape=none, fontcolor=red];\n", node, "nothing writes "+l.Channel)
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q, color=red, fontcolor=red];\n", node, l.To, l.Channel)
+		case l.To == "":
+			node := "unread_" + l.Channel
+			fmt.Fprintf(&b, "\t%q [label=%q, shape=none, fontcolor=red];\n", node, "nothing reads "+l.Channel)
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q, color=red, fontcolor=red];\n", l.From, node, l.Channel)
+		default:
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n", l.From, l.To, l.Channel)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func uniqueNames(names []string) []string {
+	unique := make([]string, 0, len(names))
+	for _, name := range names {
+		if !slices.Contains(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
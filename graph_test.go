@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+)
+
+func TestGraph(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Graph_config)
+	g := n.Graph()
+
+	if len(g.Devices) != 5 || g.Devices[0] != (GraphDevice{Name: "compass", Type: "serial", OriginTag: "cp_"}) {
+		t.Errorf("Unexpected devices %v", g.Devices)
+	}
+	if g.Devices[1] != (GraphDevice{Name: "compass_out", Type: "make_sentence", Processor: "main_processor"}) {
+		t.Errorf("Make sentence not linked to its processor %v", g.Devices[1])
+	}
+	expected := []GraphLink{
+		{Channel: "to_udp_autohelm", To: "udp_autohelm", Kind: "channel", Dangling: true},
+		{Channel: "to_nowhere", From: "compass", Kind: "channel", Dangling: true},
+		{Channel: "to_processor", From: "compass", To: "main_processor", Kind: "channel"},
+		{Channel: "to_udp_opencpn", From: "compass_out", To: "udp_opencpn", Kind: "channel"},
+		{From: "main_processor", To: "compass_out", Kind: "make_sentence"},
+	}
+	if !reflect.DeepEqual(g.Links, expected) {
+		t.Errorf("Unexpected links\n%v\n%v", g.Links, expected)
+	}
+}
+
+func TestGraphMakeSentenceWithoutProcessor(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Graph_config)
+	delete(n.Config.Values["compass_out"], "processor")
+	g := n.Graph()
+
+	// the processor does not run a make sentence without a processor setting
+	if g.Devices[1] != (GraphDevice{Name: "compass_out", Type: "make_sentence"}) {
+		t.Errorf("Make sentence should not be linked to a processor %v", g.Devices[1])
+	}
+	for _, l := range g.Links {
+		if l.Kind == "make_sentence" {
+			t.Errorf("Unexpected make sentence link %v", l)
+		}
+	}
+}
+
+func TestGraphFormats(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Graph_config)
+
+	dot := n.GraphDOT()
+	for _, line := range []string{
+		"digraph nmea_mux {",
+		`"compass" [label="compass\nserial\ntag cp_"];`,
+		`"compass" -> "main_processor" [label="to_processor"];`,
+		`"compass" -> "unread_to_nowhere" [label="to_nowhere", color=red, fontcolor=red];`,
+		`"unwritten_to_udp_autohelm" [label="nothing writes to_udp_autohelm", shape=none, fontcolor=red];`,
+		`"main_processor" -> "compass_out" [label="make_sentence", style=dashed];`,
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("DOT graph missing %s in\n%s", line, dot)
+		}
+	}
+
+	data, err := n.GraphJSON()
+	if err != nil {
+		t.Fatalf("JSON graph failed: %s", err)
+	}
+	var g Graph
+	if err := json.Unmarshal(data, &g); err != nil || !reflect.DeepEqual(g, n.Graph()) {
+		t.Errorf("JSON graph does not round trip: %s\n%s", err, data)
+	}
+	if !strings.Contains(string(data), `"dangling": true`) {
+		t.Errorf("JSON graph must flag dangling channels\n%s", data)
+	}
+}
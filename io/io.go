@@ -6,47 +6,358 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package io
 
 import (
+	"errors"
+	"fmt"
 	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Serial_interfacer interface {
 	SetMode(int, string) error
+	SetOptions(SerialOptions) error
+	SetPortSelector(SerialPortSelector) error
+	PortName() string
 	Open() error
 	Read(*[]byte) (int, error)
 	Write([]byte) (int, error)
+	Close() error
+}
+
+// Line settings of a serial port applied when it is opened. Use
+// DefaultSerialOptions for 8 data bits, no parity, 1 stop bit, no flow
+// control and DTR and RTS on.
+type SerialOptions struct {
+	DataBits    int           // 5, 6, 7 or 8
+	Parity      string        // none, odd, even, mark or space
+	StopBits    string        // 1, 1.5 or 2
+	FlowControl string        // none or rts_cts
+	ReadTimeout time.Duration // 0 waits until data arrives
+	DTR         bool          // line state set on open
+	RTS         bool
+}
+
+func DefaultSerialOptions() SerialOptions {
+	return SerialOptions{DataBits: 8, Parity: "none", StopBits: "1", FlowControl: "none", DTR: true, RTS: true}
+}
+
+var serial_parities = map[string]serial.Parity{
+	"none": serial.NoParity, "odd": serial.OddParity, "even": serial.EvenParity,
+	"mark": serial.MarkParity, "space": serial.SpaceParity,
+}
+
+var serial_stop_bits = map[string]serial.StopBits{
+	"1": serial.OneStopBit, "1.5": serial.OnePointFiveStopBits, "2": serial.TwoStopBits,
 }
 
+// How long a write waits for CTS when flow control is rts_cts
+const cts_timeout = time.Second
+
+// Returned by Write when the other end has not set CTS within cts_timeout.
+// The port is still usable so the caller can drop the data and carry on.
+var ErrCTSNotSet = errors.New("CTS not set")
+
 type SerialDevice struct {
 	baud     int
 	portName string
+	selector SerialPortSelector
+	port_mu  sync.Mutex // the port is reopened while it may be closed on shutdown
 	port     serial.Port
 	mode     *serial.Mode
+	options  SerialOptions
+}
+
+// Returns the names of the serial ports found on this computer
+func ListSerialPorts() ([]string, error) {
+	return serial.GetPortsList()
+}
+
+// A serial port found on this computer with the details of its USB
+// adapter if it has one. VID and PID are 4 digit lower case hex.
+type SerialPortDetails struct {
+	Name         string
+	IsUSB        bool
+	VID          string
+	PID          string
+	SerialNumber string
+	Product      string
+}
+
+// Returns the serial ports found on this computer with their USB details
+func ListSerialPortDetails() ([]SerialPortDetails, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	details := make([]SerialPortDetails, 0, len(ports))
+	for _, port := range ports {
+		details = append(details, SerialPortDetails{
+			Name:         port.Name,
+			IsUSB:        port.IsUSB,
+			VID:          NormaliseUsbId(port.VID),
+			PID:          NormaliseUsbId(port.PID),
+			SerialNumber: port.SerialNumber,
+			Product:      port.Product,
+		})
+	}
+	return details, nil
+}
+
+// Chooses the port to open, so that a device keeps its port when names
+// such as /dev/ttyUSB0 change order on reboot. Name may be a glob eg
+// /dev/serial/by-id/usb-FTDI_* and any USB details set must match.
+type SerialPortSelector struct {
+	Name         string
+	VID          string
+	PID          string
+	SerialNumber string
+}
+
+func (sel SerialPortSelector) usb() bool {
+	return sel.VID != "" || sel.PID != "" || sel.SerialNumber != ""
+}
+
+func (sel SerialPortSelector) String() string {
+	parts := make([]string, 0, 4)
+	if sel.Name != "" {
+		parts = append(parts, sel.Name)
+	}
+	if sel.VID != "" {
+		parts = append(parts, "usb_vid "+sel.VID)
+	}
+	if sel.PID != "" {
+		parts = append(parts, "usb_pid "+sel.PID)
+	}
+	if sel.SerialNumber != "" {
+		parts = append(parts, "usb_serial "+sel.SerialNumber)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Returns a USB id as 4 digit lower case hex eg 0x403 is 0403
+func NormaliseUsbId(id string) string {
+	id = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+	if id != "" && len(id) < 4 {
+		id = strings.Repeat("0", 4-len(id)) + id
+	}
+	return id
+}
+
+// Returns the name of the one port matching the selector
+func ResolveSerialPort(sel SerialPortSelector) (string, error) {
+	glob := strings.ContainsAny(sel.Name, "*?[")
+	if !sel.usb() && !glob {
+		return sel.Name, nil
+	}
+
+	matches := make([]string, 0)
+	if sel.usb() {
+		ports, err := ListSerialPortDetails()
+		if err != nil {
+			return "", fmt.Errorf("could not list serial ports to find %s: %w", sel, err)
+		}
+		for _, port := range ports {
+			if port.IsUSB && matchUsbPort(sel, port) {
+				matches = append(matches, port.Name)
+			}
+		}
+	} else {
+		found, err := filepath.Glob(sel.Name)
+		if err != nil {
+			return "", fmt.Errorf("serial port name %s is not a valid glob: %w", sel.Name, err)
+		}
+		matches = found
+		if len(matches) == 0 {
+			// eg COM ports on windows are not files
+			ports, _ := ListSerialPorts()
+			for _, port := range ports {
+				if ok, _ := filepath.Match(sel.Name, port); ok {
+					matches = append(matches, port)
+				}
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no serial port found matching %s", sel)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%d serial ports match %s: %s - add usb_serial or a longer name to choose one",
+			len(matches), sel, strings.Join(matches, ", "))
+	}
+}
+
+func matchUsbPort(sel SerialPortSelector, port SerialPortDetails) bool {
+	if sel.VID != "" && NormaliseUsbId(sel.VID) != port.VID {
+		return false
+	}
+	if sel.PID != "" && NormaliseUsbId(sel.PID) != port.PID {
+		return false
+	}
+	if sel.SerialNumber != "" && sel.SerialNumber != port.SerialNumber {
+		return false
+	}
+	if sel.Name != "" {
+		if ok, _ := filepath.Match(sel.Name, port.Name); !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *SerialDevice) SetMode(baud int, port string) error {
 	s.baud = baud
+	if !s.selector.usb() {
+		s.selector.Name = port
+	}
+	if s.options.DataBits == 0 {
+		s.options = DefaultSerialOptions()
+	}
 	s.mode = &serial.Mode{
 		BaudRate: s.baud,
-		StopBits: serial.OneStopBit,
-		Parity: serial.NoParity,
+		DataBits: s.options.DataBits,
+		StopBits: serial_stop_bits[s.options.StopBits],
+		Parity:   serial_parities[s.options.Parity],
+		InitialStatusBits: &serial.ModemOutputBits{
+			DTR: s.options.DTR,
+			RTS: s.options.RTS,
+		},
+	}
+	s.port_mu.Lock()
+	open_port := s.port
+	if open_port == nil && !s.selector.usb() {
+		s.portName = port
+	}
+	s.port_mu.Unlock()
+	if open_port != nil {
+		// eg trying another baud rate
+		return open_port.SetMode(s.mode)
+	}
+	return nil
+}
+
+// Sets the line settings used by the next SetMode and Open
+func (s *SerialDevice) SetOptions(options SerialOptions) error {
+	if _, found := serial_parities[options.Parity]; !found {
+		return fmt.Errorf("unknown parity %s", options.Parity)
+	}
+	if _, found := serial_stop_bits[options.StopBits]; !found {
+		return fmt.Errorf("unknown stop bits %s", options.StopBits)
+	}
+	if options.DataBits < 5 || options.DataBits > 8 {
+		return fmt.Errorf("data bits %d must be 5 to 8", options.DataBits)
+	}
+	s.options = options
+	if s.mode != nil {
+		s.SetMode(s.baud, s.portName)
 	}
-	s.portName = port
 	return nil
 }
 
+// Sets how the port is chosen each time it is opened
+func (s *SerialDevice) SetPortSelector(selector SerialPortSelector) error {
+	s.selector = selector
+	s.portName = selector.Name
+	return nil
+}
+
+// Returns the name of the port last opened
+func (s *SerialDevice) PortName() string {
+	s.port_mu.Lock()
+	defer s.port_mu.Unlock()
+	return s.portName
+}
+
+// Opens the port chosen by the selector, which is resolved again on
+// every open so that an adapter plugged back in to a different socket
+// is found
 func (s *SerialDevice) Open() error {
-	port_ser, err := serial.Open(s.portName, s.mode)
+	name, err := ResolveSerialPort(s.selector)
+	if err != nil {
+		return err
+	}
+	s.port_mu.Lock()
+	s.portName = name
+	s.port_mu.Unlock()
+	port_ser, err := serial.Open(name, s.mode)
+	if err == nil && s.options.ReadTimeout > 0 {
+		if err = port_ser.SetReadTimeout(s.options.ReadTimeout); err != nil {
+			port_ser.Close()
+			port_ser = nil
+		}
+	}
+	s.port_mu.Lock()
 	s.port = port_ser
+	s.port_mu.Unlock()
 	return err
 }
 
+func (s *SerialDevice) openPort() (serial.Port, error) {
+	s.port_mu.Lock()
+	defer s.port_mu.Unlock()
+	if s.port == nil {
+		return nil, fmt.Errorf("serial port %s is not open", s.portName)
+	}
+	return s.port, nil
+}
+
 func (s *SerialDevice) Read(buff *[]byte) (int, error) {
-	return s.port.Read(*buff)
+	port, err := s.openPort()
+	if err != nil {
+		return 0, err
+	}
+	return port.Read(*buff)
 }
 
+// Writes buff to the port. rts_cts is not hardware flow control as the
+// driver cannot handshake: CTS is only checked before the write starts,
+// the whole buffer is then written and RTS is never dropped to slow the
+// other end down.
 func (s *SerialDevice) Write(buff []byte) (int, error) {
-	return s.port.Write(buff)
+	port, err := s.openPort()
+	if err != nil {
+		return 0, err
+	}
+	if s.options.FlowControl == "rts_cts" {
+		if err := s.waitForCTS(port); err != nil {
+			return 0, err
+		}
+	}
+	return port.Write(buff)
+}
+
+func (s *SerialDevice) waitForCTS(port serial.Port) error {
+	deadline := time.Now().Add(cts_timeout)
+	for {
+		bits, err := port.GetModemStatusBits()
+		if err != nil {
+			return err
+		}
+		if bits.CTS {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w by %s within %s", ErrCTSNotSet, s.portName, cts_timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *SerialDevice) Close() error {
+	s.port_mu.Lock()
+	defer s.port_mu.Unlock()
+	if s.port == nil {
+		return nil
+	}
+	err := s.port.Close()
+	s.port = nil
+	return err
 }
 
 type UdpClientDevice struct {
@@ -131,3 +442,117 @@ func (u *UdpServerDevice) Read() (string, error) {
 	}
 	return ret_str, err
 }
+
+type TcpServer_interfacer interface {
+	Listen(server_port string) error
+	Accept() (TcpConn_interfacer, error)
+	Close() error
+}
+
+type TcpConn_interfacer interface {
+	Read(*[]byte) (int, error)
+	Write([]byte) (int, error)
+	Close() error
+	RemoteAddr() string
+}
+
+type TcpServerDevice struct {
+	listener net.Listener
+}
+
+type TcpConnDevice struct {
+	conn          net.Conn
+	write_timeout time.Duration
+}
+
+func (t *TcpServerDevice) Listen(server_port string) error {
+	var err error = nil
+	t.listener, err = net.Listen("tcp", "0.0.0.0:"+server_port)
+	return err
+}
+
+func (t *TcpServerDevice) Accept() (TcpConn_interfacer, error) {
+	conn, err := t.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &TcpConnDevice{conn: conn, write_timeout: 2 * time.Second}, nil
+}
+
+func (t *TcpServerDevice) Close() error {
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
+func (t *TcpConnDevice) Read(buff *[]byte) (int, error) {
+	return t.conn.Read(*buff)
+}
+
+// Writes with a deadline so that one stalled client cannot block the others
+func (t *TcpConnDevice) Write(buff []byte) (int, error) {
+	if t.write_timeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(t.write_timeout))
+	}
+	return t.conn.Write(buff)
+}
+
+func (t *TcpConnDevice) Close() error {
+	return t.conn.Close()
+}
+
+func (t *TcpConnDevice) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+type TcpClient_interfacer interface {
+	Open(server_address string) error
+	Close() error
+	LocalAddr() string
+	RemoteAddr() string
+	Read(*[]byte) (int, error)
+	Write([]byte) (int, error)
+}
+
+type TcpClientDevice struct {
+	conn           net.Conn
+	server_address string
+}
+
+func (t *TcpClientDevice) Open(server_address string) error {
+	var err error = nil
+	t.server_address = server_address
+	t.conn, err = net.DialTimeout("tcp", server_address, 5*time.Second)
+	return err
+}
+
+func (t *TcpClientDevice) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+func (t *TcpClientDevice) LocalAddr() string {
+	if t.conn != nil {
+		return t.conn.LocalAddr().String()
+	}
+	return ""
+}
+
+func (t *TcpClientDevice) RemoteAddr() string {
+	if t.conn != nil {
+		return t.conn.RemoteAddr().String()
+	}
+	return t.server_address
+}
+
+func (t *TcpClientDevice) Read(buff *[]byte) (int, error) {
+	return t.conn.Read(*buff)
+}
+
+func (t *TcpClientDevice) Write(buff []byte) (int, error) {
+	t.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return t.conn.Write(buff)
+}
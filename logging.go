@@ -0,0 +1,219 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	std_io "io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/martinmarsh/nmea-mux/io"
+)
+
+// Monitor messages are logged with log/slog. Each has a device attribute
+// and those enabled by a report option have a category attribute:
+//
+//	device   - sentences sent and received by devices with a report setting
+//	parse    - sentences parsed by a processor
+//	data_log - records written to the ships log
+//
+// Categorised messages are logged at debug level but only if the category
+// is in the monitor report list, other messages are logged if at or above
+// the monitor level.
+const (
+	category_device   = "device"
+	category_parse    = "parse"
+	category_data_log = "data_log"
+)
+
+// Monitor settings shared by every logger made from the mux logger
+type monitorLog struct {
+	mu       sync.Mutex
+	level    slog.Level
+	report   []string
+	sinks    []slog.Handler // console and udp as set by the monitor config
+	handlers []slog.Handler // added with AddLogHandler
+}
+
+// An slog.Handler which filters by level and category then passes each
+// record to every sink eg the console, the udp monitor and tests
+type monitorHandler struct {
+	log *monitorLog
+	ops []handlerOp // attributes and groups added by With and WithGroup
+}
+
+type handlerOp struct {
+	group string
+	attrs []slog.Attr
+}
+
+func newMonitorLog() *monitorLog {
+	return &monitorLog{
+		level:  slog.LevelInfo,
+		report: make([]string, 0),
+		sinks:  []slog.Handler{newLogSink(os.Stdout, "text")},
+	}
+}
+
+func (m *monitorLog) configure(level slog.Level, report []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level = level
+	m.report = report
+}
+
+func (m *monitorLog) setSinks(sinks []slog.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks = sinks
+}
+
+func (m *monitorLog) addHandler(h slog.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, h)
+}
+
+// Returns true if a record of this level and category is logged
+func (m *monitorLog) logs(level slog.Level, category string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if category != "" {
+		return slices.Contains(m.report, category)
+	}
+	return level >= m.level
+}
+
+func (h *monitorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	h.log.mu.Lock()
+	defer h.log.mu.Unlock()
+	return level >= h.log.level || len(h.log.report) > 0
+}
+
+func (h *monitorHandler) Handle(ctx context.Context, r slog.Record) error {
+	category := ""
+	for _, op := range h.ops {
+		for _, attr := range op.attrs {
+			if attr.Key == "category" {
+				category = attr.Value.String()
+			}
+		}
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "category" {
+			category = attr.Value.String()
+		}
+		return true
+	})
+	if !h.log.logs(r.Level, category) {
+		return nil
+	}
+
+	h.log.mu.Lock()
+	sinks := append(slices.Clone(h.log.sinks), h.log.handlers...)
+	h.log.mu.Unlock()
+	var errs []string
+	for _, sink := range sinks {
+		for _, op := range h.ops {
+			if op.group != "" {
+				sink = sink.WithGroup(op.group)
+			} else {
+				sink = sink.WithAttrs(op.attrs)
+			}
+		}
+		if !sink.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := sink.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("monitor log errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (h *monitorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &monitorHandler{log: h.log, ops: append(slices.Clip(h.ops), handlerOp{attrs: attrs})}
+}
+
+func (h *monitorHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &monitorHandler{log: h.log, ops: append(slices.Clip(h.ops), handlerOp{group: name})}
+}
+
+// Returns the logger for monitor messages. Use it to log from your own
+// code, with its device and category attributes, so that messages are
+// filtered and sent to the console and udp monitor as configured.
+func (n *NmeaMux) Logger() *slog.Logger {
+	return n.logger
+}
+
+// Adds a handler which is given every monitor message logged, eg to
+// send them to a log file or the system journal as well as the console
+func (n *NmeaMux) AddLogHandler(h slog.Handler) {
+	n.monitor_log.addHandler(h)
+}
+
+// Returns the logger used by the named device
+func (n *NmeaMux) deviceLogger(name string) *slog.Logger {
+	return n.logger.With("device", name)
+}
+
+// Makes a sink in the monitor format, text or json
+func newLogSink(w std_io.Writer, format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// Sends each record written by a sink as a udp packet
+type udpLogWriter struct {
+	udp io.UdpClient_interfacer
+}
+
+func (u udpLogWriter) Write(p []byte) (int, error) {
+	if _, err := u.udp.Write(strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Parses a monitor level setting returning false if it is not known
+func parseLogLevel(level string) (slog.Level, bool) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo, false
+	}
+	return l, true
+}
+
+// Checks the monitor level and format settings returning the problems
+// separated by ";"
+func checkMonitorLogging(config map[string][]string) string {
+	error_str := ""
+	if levels, found := config["level"]; found && len(levels) > 0 {
+		if _, ok := parseLogLevel(levels[0]); !ok {
+			error_str += fmt.Sprintf("level %s must be debug, info, warn or error;", levels[0])
+		}
+	}
+	if formats, found := config["format"]; found && len(formats) > 0 {
+		if formats[0] != "text" && formats[0] != "json" {
+			error_str += fmt.Sprintf("format %s must be text or json;", formats[0])
+		}
+	}
+	return error_str
+}
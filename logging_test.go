@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestLoggingCategories(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.monitor_log.configure(slog.LevelInfo, []string{category_parse})
+	log := n.deviceLogger("main_processor")
+	log.Debug("Debug message")
+	log.Debug("Parsing $HCHDM,200.5,M*2E", "category", category_parse)
+	log.Debug("Serial compass Rx: $HCHDM,200.5,M*2E", "category", category_device)
+	log.Info("Info message")
+	log.Warn("Warn message")
+
+	messages := test_helpers.GetMessages(monitor)
+	expected := []string{"Parsing $HCHDM,200.5,M*2E", "Info message", "Warn message"}
+	if strings.Join(messages, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %s got %s", expected, messages)
+	}
+
+	n.monitor_log.configure(slog.LevelWarn, []string{})
+	log.Info("Info message")
+	log.Debug("Parsing $HCHDM,200.5,M*2E", "category", category_parse)
+	log.Warn("Warn message")
+	messages = test_helpers.GetMessages(monitor)
+	if len(messages) != 1 || messages[0] != "Warn message" {
+		t.Errorf("Expected only the warning got %s", messages)
+	}
+}
+
+func TestLoggingJsonFormat(t *testing.T) {
+	n := NewMux()
+	var buff bytes.Buffer
+	n.monitor_log.setSinks([]slog.Handler{newLogSink(&buff, "json")})
+	n.deviceLogger("compass").Info("Serial device compass baud rate set to 4800")
+
+	var record map[string]any
+	if err := json.Unmarshal(buff.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a json record got %q error %s", buff.String(), err)
+	}
+	if record["msg"] != "Serial device compass baud rate set to 4800" || record["level"] != "INFO" || record["device"] != "compass" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestLoggingConfigChecked(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Logging_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	expected := []ConfigError{
+		{Device: "main_monitor", Problem: "format xml must be text or json"},
+		{Device: "main_monitor", Problem: "level loud must be debug, info, warn or error"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Config. Expected %d errors got %s", len(expected), err)
+	}
+	for i := range expected {
+		if errs[i] != expected[i] {
+			t.Errorf("Config. Expected %s got %s", expected[i], errs[i])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	std_io "io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (n *NmeaMux) metricsProcess(name string) error {
+	// serves the mux stats at /metrics in Prometheus text format
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	port := ""
+	if ports, found := config["port"]; found && len(ports) == 1 {
+		port = ports[0]
+	} else {
+		log.Error(fmt.Sprintf("Metrics %s must have exactly 1 port", name))
+		return fmt.Errorf("metrics %s has no port", name)
+	}
+
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", n.MetricsHandler())
+	server := &http.Server{Addr: ":" + port, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error; Metrics %s; action: ABORTED, error: %s", name, err))
+		return fmt.Errorf("metrics %s could not listen on port %s: %w", name, port, err)
+	}
+	n.onStop(name, func() { server.Close() })
+	n.goDevice(name, func(ctx context.Context) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed && ctx.Err() == nil {
+			log.Error(fmt.Sprintf("Error; Metrics %s stopped, error: %s", name, err))
+		}
+	})
+	log.Info(fmt.Sprintf("Started metrics %s on port %s", name, port))
+	return nil
+}
+
+// Returns a handler writing the mux stats in Prometheus text format, for
+// use when the metrics are served by your own http server
+func (n *NmeaMux) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		n.writeMetrics(w, time.Now())
+	})
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+var device_counters = []struct {
+	name  string
+	help  string
+	value func(DeviceStats) int64
+}{
+	{"nmea_device_sentences_in_total", "Sentences read from a port or input channel.", func(d DeviceStats) int64 { return d.SentencesIn }},
+	{"nmea_device_sentences_out_total", "Sentences written to a port or output channel.", func(d DeviceStats) int64 { return d.SentencesOut }},
+	{"nmea_device_bytes_in_total", "Bytes of the sentences read.", func(d DeviceStats) int64 { return d.BytesIn }},
+	{"nmea_device_bytes_out_total", "Bytes of the sentences written.", func(d DeviceStats) int64 { return d.BytesOut }},
+	{"nmea_device_parse_errors_total", "Bad or over long sentences.", func(d DeviceStats) int64 { return d.ParseErrors }},
+	{"nmea_device_checksum_errors_total", "Sentences dropped by the checksum setting.", func(d DeviceStats) int64 { return d.ChecksumErrors }},
+	{"nmea_device_dropped_total", "Sentences dropped because an output channel was full.", func(d DeviceStats) int64 { return d.Dropped }},
+	{"nmea_device_reconnects_total", "Times a lost port or connection was opened again.", func(d DeviceStats) int64 { return d.Reconnects }},
+	{"nmea_device_duplicates_total", "Sentences dropped by a dedup device as duplicates.", func(d DeviceStats) int64 { return d.Duplicates }},
+	{"nmea_device_replaced_total", "Sentences held by a throttle device and dropped for a newer one.", func(d DeviceStats) int64 { return d.Replaced }},
+}
+
+func (n *NmeaMux) writeMetrics(w std_io.Writer, now time.Time) {
+	stats := n.Stats()
+	devices := sortedKeys(stats.Devices)
+	for _, counter := range device_counters {
+		samples := make([]metricSample, 0, len(devices))
+		for _, device := range devices {
+			samples = append(samples, metricSample{metricLabels("device", device), float64(counter.value(stats.Devices[device]))})
+		}
+		writeMetric(w, counter.name, "counter", counter.help, samples)
+	}
+
+	n.stats_mu.Lock()
+	device_stats := make(map[string](*deviceStats), len(n.stats))
+	for name, s := range n.stats {
+		device_stats[name] = s
+	}
+	n.stats_mu.Unlock()
+	counts := make([]metricSample, 0)
+	ages := make([]metricSample, 0)
+	for _, device := range sortedKeys(device_stats) {
+		sentences := device_stats[device].sentenceCounts()
+		keys := make([]sentenceKey, 0, len(sentences))
+		for key := range sentences {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].talker != keys[j].talker {
+				return keys[i].talker < keys[j].talker
+			}
+			return keys[i].sentence_type < keys[j].sentence_type
+		})
+		for _, key := range keys {
+			labels := metricLabels("device", device, "talker", key.talker, "sentence", key.sentence_type)
+			counts = append(counts, metricSample{labels, float64(sentences[key].count)})
+			ages = append(ages, metricSample{labels, metricSeconds(now.Sub(sentences[key].last))})
+		}
+	}
+	writeMetric(w, "nmea_sentences_total", "counter", "Sentences received by talker and sentence type.", counts)
+	writeMetric(w, "nmea_sentence_age_seconds", "gauge", "Seconds since a sentence type was last received from the talker.", ages)
+
+	channels := sortedKeys(stats.Channels)
+	depths := make([]metricSample, 0, len(channels))
+	capacities := make([]metricSample, 0, len(channels))
+	high_waters := make([]metricSample, 0, len(channels))
+	drops := make([]metricSample, 0, len(channels))
+	for _, channel := range channels {
+		c := stats.Channels[channel]
+		labels := metricLabels("channel", channel)
+		depths = append(depths, metricSample{labels, float64(c.Depth)})
+		capacities = append(capacities, metricSample{labels, float64(c.Capacity)})
+		high_waters = append(high_waters, metricSample{labels, float64(c.HighWater)})
+		drops = append(drops, metricSample{labels, float64(c.Dropped)})
+	}
+	writeMetric(w, "nmea_channel_depth", "gauge", "Sentences waiting in a channel.", depths)
+	writeMetric(w, "nmea_channel_capacity", "gauge", "Sentences a channel can hold before sentences are dropped.", capacities)
+	writeMetric(w, "nmea_channel_high_water", "gauge", "Most sentences seen waiting in a channel.", high_waters)
+	writeMetric(w, "nmea_channel_dropped_total", "counter", "Sentences dropped by the channel policy when it was full.", drops)
+
+	n.processors_mu.Lock()
+	processors := make(map[string]ProcessInterfacer, len(n.Processors))
+	for name, p := range n.Processors {
+		processors[name] = p
+	}
+	n.processors_mu.Unlock()
+	variable_ages := make([]metricSample, 0)
+	log_sizes := make([]metricSample, 0)
+	for _, name := range sortedKeys(processors) {
+		handle := processors[name].GetNmeaHandle()
+		if handle != nil && handle.Nmea != nil {
+			handle.Nmea_mu.Lock()
+			updated := handle.Nmea.DateMap()
+			handle.Nmea_mu.Unlock()
+			for _, variable := range sortedKeys(updated) {
+				age := metricSeconds(now.Sub(updated[variable]))
+				variable_ages = append(variable_ages, metricSample{metricLabels("processor", name, "variable", variable), age})
+			}
+		}
+		if p, ok := processors[name].(*Processor); ok {
+			log_sizes = append(log_sizes, metricSample{metricLabels("processor", name), float64(p.log_bytes.Load())})
+		}
+	}
+	writeMetric(w, "nmea_processor_variable_age_seconds", "gauge", "Seconds since a processor variable was updated.", variable_ages)
+	writeMetric(w, "nmea_processor_log_file_bytes", "gauge", "Size of the ships log being written.", log_sizes)
+}
+
+func writeMetric(w std_io.Writer, name string, kind string, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, sample.labels, strconv.FormatFloat(sample.value, 'g', -1, 64))
+	}
+}
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats label name and value pairs eg {device="compass"}
+func metricLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], label_escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func metricSeconds(d time.Duration) float64 {
+	return float64(d.Milliseconds()) / 1000
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	std_io "io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+	"github.com/martinmarsh/nmea0183"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Dedup_config)
+	n.monitor_active = true
+	n.RunDevice("opencpn_dedup", n.devices["opencpn_dedup"])
+	n.Channels["to_dedup"] <- "$IIDPT,5.2,0.5*42"
+	n.Channels["to_dedup"] <- "@ray_@$IIDPT,5.3,0.5*43"
+	n.Channels["to_dedup"] <- "$SDDPT,5.4,0.5*58"
+	test_helpers.GetMessages(monitor)
+
+	recorder := httptest.NewRecorder()
+	n.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if content := recorder.Header().Get("Content-Type"); !strings.HasPrefix(content, "text/plain; version=0.0.4") {
+		t.Errorf("Expected Prometheus text format got %s", content)
+	}
+	metrics := strings.Split(recorder.Body.String(), "\n")
+	expected := []string{
+		"# TYPE nmea_device_sentences_in_total counter",
+		`nmea_device_sentences_in_total{device="opencpn_dedup"} 3`,
+		`nmea_device_dropped_total{device="opencpn_dedup"} 0`,
+		`nmea_device_duplicates_total{device="opencpn_dedup"} 0`,
+		"# TYPE nmea_sentences_total counter",
+		`nmea_sentences_total{device="opencpn_dedup",talker="II",sentence="DPT"} 2`,
+		`nmea_sentences_total{device="opencpn_dedup",talker="SD",sentence="DPT"} 1`,
+		`nmea_channel_depth{channel="to_udp_opencpn"} 3`,
+		`nmea_channel_capacity{channel="to_dedup"} 30`,
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected, metrics); not_found {
+		t.Errorf("Metrics error %s in %s", err, recorder.Body.String())
+	}
+}
+
+func TestMetricsProcessor(t *testing.T) {
+	n := NewMux()
+	var sentences nmea0183.Sentences
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	name := "main_processor"
+	process := n.newProcessor(&sentences)
+	if err := n.nmeaProcessorConfig(name, process, &sentences); err != nil {
+		t.Errorf("Processor Config Error %s", err)
+	}
+	n.Processors[name] = process
+	process.PutData(map[string]string{"hdm": "123.4"})
+	process.log_bytes.Store(2048)
+
+	var metrics strings.Builder
+	n.writeMetrics(&metrics, time.Now().Add(2*time.Second))
+	lines := strings.Split(metrics.String(), "\n")
+	if _, _, not_found, err := test_helpers.MessagesIn([]string{`nmea_processor_log_file_bytes{processor="main_processor"} 2048`}, lines); not_found {
+		t.Errorf("Metrics error %s in %s", err, metrics.String())
+	}
+	found := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, `nmea_processor_variable_age_seconds{processor="main_processor",variable="hdm"} 2`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected hdm to be 2 seconds old in %s", metrics.String())
+	}
+}
+
+func TestMetricsDevice(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	n := NewMux()
+	if err := n.LoadConfigFromMap(map[string]any{"grafana": map[string]any{"type": "metrics", "port": port}}); err != nil {
+		t.Errorf("Metrics config error %s", err)
+	}
+	n.monitor_active = true
+	if err := n.RunContext(context.Background()); err != nil {
+		t.Errorf("Run error %s", err)
+	}
+	defer n.Shutdown(context.Background())
+
+	response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+	if err != nil {
+		t.Fatalf("Metrics not served %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := std_io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "# TYPE nmea_channel_depth gauge") {
+		t.Errorf("Expected metrics got %d %s", response.StatusCode, body)
+	}
+}
@@ -8,22 +8,43 @@ Licensed under the Apache License, Version 2.0 (the "License");Licensed under th
 package nmea_mux
 
 import (
+	"context"
 	"fmt"
 	"github.com/martinmarsh/nmea-mux/io"
 	"github.com/spf13/viper"
+	std_io "io"
+	"log/slog"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MuxInterfacer interface {
 	LoadConfig(...string) error
+	LoadConfigFromReader(std_io.Reader, string) error
+	LoadConfigFromMap(map[string]any) error
 	Monitor(string, bool, bool)
 	Run() error
+	RunContext(context.Context) error
+	Shutdown(context.Context) error
 	RunDevice(string, device) error
 	RunMonitor(string)
+	Health() map[string]error
 	serialProcess(string) error
 	udpClientProcess(name string) error
 	udpListenerProcess(string) error
+	tcpServerProcess(string) error
+	tcpClientProcess(string) error
+	recorderProcess(string) error
+	playerProcess(string) error
+	filterProcess(string) error
+	throttleProcess(string) error
+	rewriteProcess(string) error
+	dedupProcess(string) error
+	metricsProcess(string) error
 	nmeaProcessorProcess(string) error
 	nmeaProcessorConfig(string, *Processor) error
 }
@@ -38,13 +59,18 @@ type configData struct {
 
 type NmeaMux struct {
 	Config             *configData
+	settings           *viper.Viper
+	config_dir         string
 	udp_monitor_active bool
 	monitor_active     bool
 	Monitor_channel    chan string
 	monitor_address	   string
 	monitor_print	   bool
 	monitor_udp		   bool
-	monitor_report	   []string
+	monitor_format     string
+	monitor_log        *monitorLog
+	logger             *slog.Logger
+	stats_period       time.Duration
 	udp_monitor		   *io.UdpClientDevice
 	Stop_channel       chan string
 	Channels           map[string](chan string)
@@ -52,14 +78,43 @@ type NmeaMux struct {
 	SerialIoDevices    map[string](io.Serial_interfacer)
 	UdpClientIoDevices map[string](io.UdpClient_interfacer)
 	UdpServerIoDevices map[string](io.UdpServer_interfacer)
+	TcpServerIoDevices map[string](io.TcpServer_interfacer)
+	TcpClientIoDevices map[string](io.TcpClient_interfacer)
 	Processors		   map[string](ProcessInterfacer)
 	ExternalDevices    map[string](map[string][]string)
+	ctx                context.Context
+	cancel             context.CancelFunc
+	running            map[string](*deviceRun)
+	running_mu         sync.Mutex
+	monitor_ctx        context.Context
+	monitor_cancel     context.CancelFunc
+	monitor_wg         sync.WaitGroup
+	channels_mu        sync.Mutex
+	policies           *channelPolicies
+	taps               map[string](*channelTap)
+	server_taps        map[string]serverTap // by tcp server name
+	started            bool
+	processors_mu      sync.Mutex
+	reload_mu          sync.Mutex
+	stats              map[string](*deviceStats)
+	channel_stats      map[string]ChannelStats
+	stats_mu           sync.Mutex
 }
 
 // A device is the top level item in the mux config
 // type device func(m *NmeaMux)
 type device func(n *NmeaMux, s string) error
 
+// Tracks the go routines started by a device so that they can
+// be cancelled and waited for on shutdown
+type deviceRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	active atomic.Int32 // go routines still working, not counting onStop waits
+	device Device       // set for registered device types
+}
+
 // Creates a new instance of the mux "machine"
 // typically create one and run it for ever so that
 // the PC / Raspberry Pi etc acts as NMEA sentence processor
@@ -73,7 +128,8 @@ func NewMux() *NmeaMux {
 		monitor_address:	"",
 		monitor_print:	    true,
 		monitor_udp:		false,
-		monitor_report:     make([]string, 0),
+		monitor_format:     "text",
+		monitor_log:        newMonitorLog(),
 		udp_monitor:		&io.UdpClientDevice{},
 		Channels:           make(map[string](chan string)),
 		devices:            make(map[string](device)),
@@ -81,15 +137,22 @@ func NewMux() *NmeaMux {
 		SerialIoDevices:    make(map[string](io.Serial_interfacer)),
 		UdpClientIoDevices: make(map[string](io.UdpClient_interfacer)),
 		UdpServerIoDevices: make(map[string](io.UdpServer_interfacer)),
+		TcpServerIoDevices: make(map[string](io.TcpServer_interfacer)),
+		TcpClientIoDevices: make(map[string](io.TcpClient_interfacer)),
 		Processors: 		make(map[string](ProcessInterfacer)),		
-		Config: &configData{
-			Index:          make(map[string]([]string)),
-			TypeList:       make(map[string]([]string)),
-			InChannelList:  make(map[string]([]string)),
-			OutChannelList: make(map[string]([]string)),
-			Values:         make(map[string]map[string]([]string)),
-		},
+		Config:             newConfigData(),
+		settings:           viper.New(),
+		config_dir:         ".",
+		running: make(map[string](*deviceRun)),
+		taps:    make(map[string](*channelTap)),
+		server_taps: make(map[string]serverTap),
+		policies: &channelPolicies{by_channel: make(map[chan string](*channelState))},
+		stats:         make(map[string](*deviceStats)),
+		channel_stats: make(map[string]ChannelStats),
 	}
+	n.logger = slog.New(&monitorHandler{log: n.monitor_log})
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.monitor_ctx, n.monitor_cancel = context.WithCancel(context.Background())
 	return &n
 }
 
@@ -103,16 +166,18 @@ func (n *NmeaMux) LoadConfig(settings ...string) error {
 	configSet := []string{".", "config", "yaml", ""}
 	copy(configSet, settings)
 
-	viper.AddConfigPath(configSet[0]) // optionally look for config in the working directory
-	viper.SetConfigName(configSet[1]) // name of config file (without extension)
-	viper.SetConfigType(configSet[2]) // REQUIRED if the config file does not have the extension in the name
+	n.config_dir = configSet[0]
+	// a new viper so that paths from an earlier load are not searched
+	n.settings = viper.New()
+	n.settings.AddConfigPath(configSet[0]) // optionally look for config in the working directory
+	n.settings.SetConfigName(configSet[1]) // name of config file (without extension)
+	n.settings.SetConfigType(configSet[2]) // REQUIRED if the config file does not have the extension in the name
 	var err error = nil
-	err_str := ""
 
 	if configSet[3] == "" {
-		err = viper.ReadInConfig() // Find and read the config file
+		err = n.settings.ReadInConfig() // Find and read the config file
 	} else {
-		err = viper.ReadConfig(strings.NewReader(configSet[3]))
+		err = n.settings.ReadConfig(strings.NewReader(configSet[3]))
 	}
 
 	if err != nil {
@@ -126,106 +191,210 @@ func (n *NmeaMux) LoadConfig(settings ...string) error {
 		}
 	}
 
-	all := viper.AllKeys()
+	return n.applyConfig()
+}
+
+// Loads a configuration from a reader in the given format eg yaml
+// so that a mux can be built without a config file
+func (n *NmeaMux) LoadConfigFromReader(reader std_io.Reader, format string) error {
+	n.settings = viper.New()
+	n.settings.SetConfigType(format)
+	if err := n.settings.ReadConfig(reader); err != nil {
+		return fmt.Errorf("config file error - check format - could not load: %s", err)
+	}
+	return n.applyConfig()
+}
+
+// Loads a configuration from a map of device names to their settings
+// eg {"to_2000": {"type": "serial", "name": "/dev/ttyUSB0", "baud": 4800}}
+func (n *NmeaMux) LoadConfigFromMap(config map[string]any) error {
+	n.settings = viper.New()
+	if err := n.settings.MergeConfigMap(config); err != nil {
+		return fmt.Errorf("config map error - could not load: %s", err)
+	}
+	return n.applyConfig()
+}
+
+// Collects the loaded settings into Config, creates the channels and
+// sets up the devices ready to run. Returns ConfigErrors if the config
+// is not valid.
+func (n *NmeaMux) applyConfig() error {
+	n.Config = newConfigData()
+	collectConfig(n.settings, n.Config)
+	n.makeChannels()
+
+	for processType, names := range n.Config.TypeList {
+		for _, name := range names {
+			n.addDevice(processType, name)
+		}
+	}
+	return n.Validate()
+}
+
+func newConfigData() *configData {
+	return &configData{
+		Index:          make(map[string]([]string)),
+		TypeList:       make(map[string]([]string)),
+		InChannelList:  make(map[string]([]string)),
+		OutChannelList: make(map[string]([]string)),
+		Values:         make(map[string]map[string]([]string)),
+	}
+}
+
+// Collects the keys read by settings into config
+func collectConfig(settings *viper.Viper, config *configData) {
+	all := settings.AllKeys()
 
 	// Find keys in yaml assumes >2 deep collects map by 1st part of key
 	// also find names by device type every section has a type
 	for _, k := range all {
 		key := strings.SplitN(k, ".", 2)
-		if _, ok := n.Config.Values[key[0]]; !ok {
-			n.Config.Values[key[0]] = make(map[string][]string)
+		if _, ok := config.Values[key[0]]; !ok {
+			config.Values[key[0]] = make(map[string][]string)
 		}
-		if _, ok := n.Config.Values[key[0]][key[1]]; !ok {
-			n.Config.Values[key[0]][key[1]] = viper.GetStringSlice(k)
+		if _, ok := config.Values[key[0]][key[1]]; !ok {
+			config.Values[key[0]][key[1]] = settings.GetStringSlice(k)
 		}
 
 		if key[1] == "type" {
-			type_value := viper.GetString(k)
-			if _, ok := n.Config.TypeList[type_value]; !ok {
-				n.Config.TypeList[type_value] = []string{key[0]}
+			type_value := settings.GetString(k)
+			if _, ok := config.TypeList[type_value]; !ok {
+				config.TypeList[type_value] = []string{key[0]}
 			} else {
-				n.Config.TypeList[type_value] = append(n.Config.TypeList[type_value], key[0])
+				config.TypeList[type_value] = append(config.TypeList[type_value], key[0])
 			}
 		}
 
 		if key[1] == "input" {
-			channel_value := viper.GetString(k)
-			if _, ok := n.Config.InChannelList[channel_value]; !ok {
-				n.Config.InChannelList[channel_value] = []string{key[0]}
+			channel_value := settings.GetString(k)
+			if _, ok := config.InChannelList[channel_value]; !ok {
+				config.InChannelList[channel_value] = []string{key[0]}
 			} else {
-				n.Config.InChannelList[channel_value] = append(n.Config.InChannelList[channel_value], key[0])
+				config.InChannelList[channel_value] = append(config.InChannelList[channel_value], key[0])
 			}
 		}
 
-		if key[1] == "outputs" {
-			for _, channel_name := range n.Config.Values[key[0]][key[1]] {
-				if _, ok := n.Config.OutChannelList[channel_name]; !ok {
-					n.Config.OutChannelList[channel_name] = []string{key[0]}
+		// outputs may be nested eg routes.<name>.outputs of a filter
+		if key[1] == "outputs" || strings.HasSuffix(key[1], ".outputs") {
+			for _, channel_name := range config.Values[key[0]][key[1]] {
+				if _, ok := config.OutChannelList[channel_name]; !ok {
+					config.OutChannelList[channel_name] = []string{key[0]}
 				} else {
-					n.Config.OutChannelList[channel_name] = append(n.Config.OutChannelList[channel_name], key[0])
+					config.OutChannelList[channel_name] = append(config.OutChannelList[channel_name], key[0])
 				}
 			}
 		}
 
-		if _, ok := n.Config.Index[key[0]]; !ok {
-			n.Config.Index[key[0]] = []string{key[1]}
+		if _, ok := config.Index[key[0]]; !ok {
+			config.Index[key[0]] = []string{key[1]}
 		} else {
-			n.Config.Index[key[0]] = append(n.Config.Index[key[0]], key[1])
+			config.Index[key[0]] = append(config.Index[key[0]], key[1])
 		}
 	}
+}
 
+// Creates any channel in the config which does not already exist with
+// the capacity and policy of its channel section, if it has one. Channels
+// which are not wired together are created anyway and may fill up. The
+// policy of an existing channel is updated but its capacity is kept.
+func (n *NmeaMux) makeChannels() {
+	n.channels_mu.Lock()
+	defer n.channels_mu.Unlock()
+	names := make(map[string]bool)
 	for channel := range n.Config.InChannelList {
-		if n.Config.OutChannelList[channel] == nil {
-			err_str += channel + ","
-		}
-		// Create every input channel - the error ones will block
-		n.Channels[channel] = make(chan string, 30)
-
+		names[channel] = true
 	}
 	for channel := range n.Config.OutChannelList {
-		if n.Config.InChannelList[channel] == nil {
-			err_str += channel + ","
-			//Create the not used channel anyway - may block when full
-			n.Channels[channel] = make(chan string, 30)
+		names[channel] = true
+	}
+	for channel := range names {
+		policy := n.channelPolicy(channel)
+		if _, found := n.Channels[channel]; !found {
+			n.Channels[channel] = make(chan string, policy.capacity)
+		} else if cap(n.Channels[channel]) != policy.capacity {
+			n.logger.Warn(fmt.Sprintf("Channel %s capacity change to %d needs a restart of the mux", channel, policy.capacity))
 		}
-
+		n.policies.set(n.Channels[channel], channel, policy)
 	}
+}
 
-	if err_str != "" {
-		err_str = fmt.Sprintf("input channels and output channels must be wired together: check these channels %s -", err_str)
+// Returns a copy of the channels for the named device to use while it
+// runs so that channels can be added on reload without disturbing it.
+// A device writing to a tapped channel is given the tap in its place.
+func (n *NmeaMux) deviceChannels(name string) *map[string](chan string) {
+	n.channels_mu.Lock()
+	defer n.channels_mu.Unlock()
+	input := ""
+	if inputs := n.Config.Values[name]["input"]; len(inputs) > 0 {
+		input = inputs[0]
 	}
-
-	for processType, names := range n.Config.TypeList {
-		//fmt.Println(processType, names)
-		for _, name := range names {
-			switch processType {
-			case "serial":
-				n.devices[name] = (*NmeaMux).serialProcess
-				n.SerialIoDevices[name] = &io.SerialDevice{}
-			case "udp_client":
-				n.devices[name] = (*NmeaMux).udpClientProcess
-				n.UdpClientIoDevices[name] = &io.UdpClientDevice{}
-			case "nmea_processor":
-				n.devices[name] = (*NmeaMux).nmeaProcessorProcess
-			case "udp_listen":
-				n.devices[name] = (*NmeaMux).udpListenerProcess
-				n.UdpServerIoDevices[name] = &io.UdpServerDevice{}
-			case "make_sentence":
-			case "monitor":
-				n.devices[name] = (*NmeaMux).RunMonitor
-			case "external":
-				n.ExternalDevices[name] = n.Config.Values[name]
-			default:
-				err_str = fmt.Sprintf("%sUnknown device found: %s -", err_str, processType)
-			}
-
+	channels := make(map[string](chan string), len(n.Channels))
+	for channel_name, channel := range n.Channels {
+		if tap, found := n.taps[channel_name]; found && channel_name != input {
+			channel = tap.in
 		}
+		channels[channel_name] = channel
 	}
-	if err_str != "" {
-		err = fmt.Errorf("config errors found: %s", err_str)
-	}
+	return &channels
+}
 
-	return err
+// Sets the device method for the named device of the given type. Io
+// devices are only created if not already set, so that mocks injected
+// for testing are kept on reload. Unknown types are reported by Validate.
+func (n *NmeaMux) addDevice(processType string, name string) {
+	switch processType {
+	case "serial":
+		n.devices[name] = (*NmeaMux).serialProcess
+		if _, found := n.SerialIoDevices[name]; !found {
+			n.SerialIoDevices[name] = &io.SerialDevice{}
+		}
+	case "udp_client":
+		n.devices[name] = (*NmeaMux).udpClientProcess
+		if _, found := n.UdpClientIoDevices[name]; !found {
+			n.UdpClientIoDevices[name] = &io.UdpClientDevice{}
+		}
+	case "nmea_processor":
+		n.devices[name] = (*NmeaMux).nmeaProcessorProcess
+	case "udp_listen":
+		n.devices[name] = (*NmeaMux).udpListenerProcess
+		if _, found := n.UdpServerIoDevices[name]; !found {
+			n.UdpServerIoDevices[name] = &io.UdpServerDevice{}
+		}
+	case "tcp_server":
+		n.devices[name] = (*NmeaMux).tcpServerProcess
+		if _, found := n.TcpServerIoDevices[name]; !found {
+			n.TcpServerIoDevices[name] = &io.TcpServerDevice{}
+		}
+	case "tcp_client":
+		n.devices[name] = (*NmeaMux).tcpClientProcess
+		if _, found := n.TcpClientIoDevices[name]; !found {
+			n.TcpClientIoDevices[name] = &io.TcpClientDevice{}
+		}
+	case "recorder":
+		n.devices[name] = (*NmeaMux).recorderProcess
+	case "player":
+		n.devices[name] = (*NmeaMux).playerProcess
+	case "filter":
+		n.devices[name] = (*NmeaMux).filterProcess
+	case "throttle":
+		n.devices[name] = (*NmeaMux).throttleProcess
+	case "rewrite":
+		n.devices[name] = (*NmeaMux).rewriteProcess
+	case "dedup":
+		n.devices[name] = (*NmeaMux).dedupProcess
+	case "metrics":
+		n.devices[name] = (*NmeaMux).metricsProcess
+	case "make_sentence":
+	case "channel":
+	case "monitor":
+		n.devices[name] = (*NmeaMux).RunMonitor
+	case "external":
+		n.ExternalDevices[name] = n.Config.Values[name]
+	default:
+		if factory, found := registeredDeviceType(processType); found {
+			n.devices[name] = customDevice(factory)
+		}
+	}
 }
 
 func (n *NmeaMux) Monitor(str string, print bool, udp bool) {
@@ -237,19 +406,129 @@ func (n *NmeaMux) Monitor(str string, print bool, udp bool) {
 	}
 }
 
+// Blocks until a message is sent on Stop_channel or the context
+// given to RunContext is cancelled then shuts the mux down
 func (n *NmeaMux) WaitToStop() {
-	//run forever
-	<-n.Stop_channel
+	select {
+	case <-n.Stop_channel:
+	case <-n.Context().Done():
+	}
+	n.Shutdown(context.Background())
 }
 
 // Runs the Config devices
 func (n *NmeaMux) Run() error {
+	return n.RunContext(context.Background())
+}
+
+// Runs the Config devices until ctx is cancelled or Shutdown is called
+func (n *NmeaMux) RunContext(ctx context.Context) error {
+	// devices already started, eg by RunDevice, read n.ctx under running_mu
+	n.running_mu.Lock()
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	n.running_mu.Unlock()
+	n.tapServers()
+	n.channels_mu.Lock()
+	n.started = true
+	n.channels_mu.Unlock()
+	n.startTaps()
 	for name, v := range n.devices {
 		n.RunDevice(name, v)
 	}
 	return nil
 }
 
+// Returns the context which is cancelled when the mux shuts down.
+// External devices should stop their go routines when it is done.
+func (n *NmeaMux) Context() context.Context {
+	n.running_mu.Lock()
+	defer n.running_mu.Unlock()
+	return n.ctx
+}
+
+// Cancels every device, waits for their go routines to exit, closing
+// ports and flushing logs, then stops the monitor. Returns ctx.Err()
+// if ctx is done before everything has stopped.
+func (n *NmeaMux) Shutdown(ctx context.Context) error {
+	n.running_mu.Lock()
+	cancel := n.cancel
+	n.running_mu.Unlock()
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		n.running_mu.Lock()
+		runs := make([](*deviceRun), 0, len(n.running))
+		for _, run := range n.running {
+			runs = append(runs, run)
+		}
+		n.running_mu.Unlock()
+		for _, run := range runs {
+			run.wg.Wait()
+		}
+		n.monitor_cancel()
+		n.monitor_wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the run state of the named device creating it if this is
+// the first go routine started for the device
+func (n *NmeaMux) deviceRunState(name string) *deviceRun {
+	n.running_mu.Lock()
+	defer n.running_mu.Unlock()
+	run, found := n.running[name]
+	if !found {
+		run = &deviceRun{}
+		run.ctx, run.cancel = context.WithCancel(n.ctx)
+		n.running[name] = run
+	}
+	return run
+}
+
+// Starts f as a go routine belonging to the named device. The context
+// passed to f is done when the device must stop.
+func (n *NmeaMux) goDevice(name string, f func(ctx context.Context)) {
+	run := n.deviceRunState(name)
+	run.wg.Add(1)
+	run.active.Add(1)
+	go func() {
+		defer run.wg.Done()
+		defer run.active.Add(-1)
+		f(run.ctx)
+	}()
+}
+
+// Calls f when the named device is stopped, typically to close a port
+// so that a blocked read returns
+func (n *NmeaMux) onStop(name string, f func()) {
+	run := n.deviceRunState(name)
+	run.wg.Add(1)
+	go func() {
+		defer run.wg.Done()
+		<-run.ctx.Done()
+		f()
+	}()
+}
+
+// Sleeps for d returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
 func (n *NmeaMux) monitor_start() {
 	if !n.monitor_active {
 		if _, found := n.Config.TypeList["monitor"]; found {
@@ -274,6 +553,8 @@ func (n *NmeaMux) RunDevice(name string, device_method device) error {
 // Must be started before run
 func (n *NmeaMux) RunMonitor(name string) error {
 	if mon_config, found := n.Config.Values[name]; found {
+		level := slog.LevelInfo
+		report := make([]string, 0)
 		for i, v := range(mon_config){
 			switch i {
 			case "server_address":
@@ -291,30 +572,76 @@ func (n *NmeaMux) RunMonitor(name string) error {
 					n.monitor_udp = false
 				}
 			case "report":
-				n.monitor_report = v
+				report = v
+			case "level":
+				level, _ = parseLogLevel(v[0])
+			case "format":
+				n.monitor_format = v[0]
+			case "stats_period":
+				if period, err := strconv.Atoi(v[0]); err == nil {
+					n.stats_period = time.Duration(period) * time.Second
+				}
 			}		
 		}
-
+		n.monitor_log.configure(level, report)
 	}
 	if !n.monitor_active {
 		n.monitor_active = true
-		go n.backgroundMonitor()
+		sinks := make([]slog.Handler, 0, 2)
+		if n.monitor_print {
+			sinks = append(sinks, newLogSink(os.Stdout, n.monitor_format))
+		}
+		n.udp_monitor_active = false
+		if len(n.monitor_address) > 12 && n.monitor_udp {
+			if err := n.udp_monitor.Open(n.monitor_address); err == nil {
+				n.udp_monitor_active = true
+				sinks = append(sinks, newLogSink(udpLogWriter{n.udp_monitor}, n.monitor_format))
+			}
+		}
+		n.monitor_log.setSinks(sinks)
+		n.monitor_wg.Add(1)
+		go func() {
+			defer n.monitor_wg.Done()
+			n.backgroundMonitor(n.monitor_ctx)
+		}()
+		n.monitor_wg.Add(1)
+		go func() {
+			defer n.monitor_wg.Done()
+			n.statsSampler(n.monitor_ctx, n.stats_period)
+		}()
 		time.Sleep(100 * time.Millisecond)
 	}
 	return nil
 }
 
-func (n *NmeaMux) backgroundMonitor() {
-	n.udp_monitor_active = false
-	if len(n.monitor_address) > 12 && n.monitor_udp {
-		if err := n.udp_monitor.Open(n.monitor_address); err == nil {
-			defer n.udp_monitor.Close()
-			n.udp_monitor_active = true
-		}
+// Logs messages sent on Monitor_channel, eg by external devices, until
+// ctx is done then closes the udp monitor
+func (n *NmeaMux) backgroundMonitor(ctx context.Context) {
+	if n.udp_monitor_active {
+		defer func() {
+			sinks := make([]slog.Handler, 0, 1)
+			if n.monitor_print {
+				sinks = append(sinks, newLogSink(os.Stdout, n.monitor_format))
+			}
+			n.monitor_log.setSinks(sinks)
+			n.udp_monitor.Close()
+		}()
 	}
 	for {
-		str := <-n.Monitor_channel
-		n.Monitor(str, n.monitor_print, n.udp_monitor_active)
+		select {
+		case str := <-n.Monitor_channel:
+			n.logger.Info(str)
+		case <-ctx.Done():
+			// report anything sent while the devices were stopping
+			for {
+				select {
+				case str := <-n.Monitor_channel:
+					n.logger.Info(str)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
 
@@ -1,87 +1,265 @@
 package main
 
 import (
-	"github.com/martinmarsh/nmea-mux"
-	"strconv"
-	"time"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/martinmarsh/nmea-mux"
+	"github.com/martinmarsh/nmea-mux/io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
+const usage = `usage: nmea_mux [command] [options]
+
+commands:
+  run        run the mux (default)
+  validate   load and check the config without opening any ports
+  graph      print how devices are wired together by channels
+             --format dot or json for Graphviz or other tools
+  list-ports list the serial ports on this computer with their USB ids
+  tail       print the sentences sent to a channel of the running mux eg: nmea_mux tail to_processor
+             needs a tcp_server with tap: to_processor in the config, --host of the mux (default localhost)
+
+options are given before any arguments:
+  --config   path to the config file (default ./config.yaml)
+`
+
 func main() {
-	n := nmea_mux.NewMux()
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
 
-	// for default config.yaml in current folder
-	// optional parameters define folder, filename, format, "config as a string
-	if err := n.LoadConfig(); err == nil {
-		n.Run()        // Run the virtual devices / go tasks
-		external(n)
-		n.WaitToStop() // Wait for ever?
-		
-	}else{
+	var err error
+	switch command {
+	case "run":
+		err = run(args)
+	case "validate":
+		err = validate(args)
+	case "graph":
+		err = graph(args)
+	case "list-ports":
+		err = listPorts()
+	case "tail":
+		err = tail(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		err = fmt.Errorf("unknown command %s\n%s", command, usage)
+	}
+	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
-
-type nmeaData struct{
-	gain			float32
-	pd				float32
-	pi 				float32
-	autohelm_channels		map[string](chan string)
+// Parses the options returning an error if more than max_args arguments
+// follow them. Parsing stops at the first argument so an option after it
+// would otherwise be ignored.
+func parseOptions(flags *flag.FlagSet, args []string, max_args int) error {
+	flags.Parse(args)
+	for _, arg := range flags.Args() {
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("option %s must be given before any arguments\n%s", arg, usage)
+		}
+	}
+	if flags.NArg() > max_args {
+		return fmt.Errorf("unexpected arguments %s\n%s", strings.Join(flags.Args()[max_args:], " "), usage)
+	}
+	return nil
 }
 
+// Parses the command options and loads the config returning the mux
+func loadMux(command string, args []string) (*nmea_mux.NmeaMux, error) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	config_path := flags.String("config", "./config.yaml", "path to the config file")
+	if err := parseOptions(flags, args, 0); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(*config_path)
+	ext := filepath.Ext(*config_path)
+	name := strings.TrimSuffix(filepath.Base(*config_path), ext)
+	if ext == "" {
+		ext = ".yaml"
+	}
 
-func external(mux *nmea_mux.NmeaMux){
-	//example of using an external process as defined in config by type external
+	n := nmea_mux.NewMux()
+	err := n.LoadConfig(dir, name, strings.TrimPrefix(ext, "."))
+	return n, err
+}
 
-	nmea_data := nmeaData{}
-	nmea_data.autohelm_channels = make(map[string](chan string))
-	
-	all_channels := &mux.Channels
+func run(args []string) error {
+	n, err := loadMux("run", args)
+	if err != nil {
+		return err
+	}
 
-	// external autohelm setup
-	config, is_set := mux.Config.Values["auto_helm"]
+	// stop cleanly on Ctrl-C or when the system powers down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if is_set {
-		nmea_data.pd, _ = getFloat32(100.0, config["pd"][0], 0, true)
-		nmea_data.pi, _ = getFloat32(100.0, config["pi"][0], 0, true)
-		nmea_data.gain, _ = getFloat32(100.0, config["gain"][0], 0, true)
+	n.RunContext(ctx) // Run the virtual devices / go tasks until signalled
+	n.WatchConfig()   // Restart devices whose settings change in the config file
+	n.WaitToStop()    // Wait until stopped then close ports and flush logs
+	return nil
+}
 
-		for _, v := range(config["outputs"]){
-			nmea_data.autohelm_channels[v] = (*all_channels)[v]
+func validate(args []string) error {
+	_, err := loadMux("validate", args)
+	var errs nmea_mux.ConfigErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			fmt.Println(e)
 		}
+		return fmt.Errorf("%d config errors found", len(errs))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("config ok")
+	return nil
+}
 
-		go process_autohelm(&nmea_data, mux)
+func graph(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "text", "text, dot for Graphviz or json")
+	config_path := flags.String("config", "./config.yaml", "path to the config file")
+	if err := parseOptions(flags, args, 0); err != nil {
+		return err
 	}
 
-}
+	n, err := loadMux("graph", []string{"--config", *config_path})
+	var errs nmea_mux.ConfigErrors
+	if err != nil && !errors.As(err, &errs) {
+		return err
+	}
 
+	switch *format {
+	case "dot":
+		fmt.Print(n.GraphDOT())
+		return nil
+	case "json":
+		data, err := n.GraphJSON()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case "text":
+	default:
+		return fmt.Errorf("unknown graph format %s must be text, dot or json", *format)
+	}
 
-func process_autohelm(d *nmeaData, mux *nmea_mux.NmeaMux){
+	g := n.Graph()
+	for _, d := range g.Devices {
+		fmt.Printf("%s (%s)\n", d.Name, d.Type)
+		if d.Type == "make_sentence" && d.Processor == "" {
+			fmt.Println("    NOT RUN - add a processor setting")
+		}
+		for _, l := range g.Links {
+			switch {
+			case l.To == d.Name && l.Kind == "make_sentence":
+				fmt.Printf("    made by %s\n", l.From)
+			case l.To == d.Name && l.From == "":
+				fmt.Printf("    <- %s  NOTHING WRITES TO THIS CHANNEL\n", l.Channel)
+			case l.To == d.Name:
+				fmt.Printf("    <- %s from %s\n", l.Channel, l.From)
+			case l.From == d.Name && l.To == "":
+				fmt.Printf("    -> %s  NOTHING READS THIS CHANNEL\n", l.Channel)
+			case l.From == d.Name && l.Kind == "channel":
+				fmt.Printf("    -> %s to %s\n", l.Channel, l.To)
+			}
+		}
+	}
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	return nil
+}
 
-	helm_ticker := time.NewTicker(500 * time.Millisecond)
+// Prints each port with the settings to select its USB adapter
+func listPorts() error {
+	ports, err := io.ListSerialPortDetails()
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		fmt.Println("no serial ports found")
+	}
+	for _, port := range ports {
+		if !port.IsUSB {
+			fmt.Println(port.Name)
+			continue
+		}
+		fmt.Printf("%s usb_vid: \"%s\" usb_pid: \"%s\" usb_serial: %s %s\n",
+			port.Name, port.VID, port.PID, port.SerialNumber, port.Product)
+	}
+	return nil
+}
 
-	for {
-		<- helm_ticker.C
-		data := mux.Processors["main_processor"].GetData("cp_")
-		fmt.Println(data)
-		data["cp_newvar"] = "3456" 
-		data["cp_newvar2"] = "new value 2" 
-		mux.Processors["main_processor"].PutData(data) 
-	
+// Prints the sentences sent to a channel of the running mux by connecting
+// to the tcp server tapping it, so no ports used by the mux are opened
+func tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	config_path := flags.String("config", "./config.yaml", "path to the config file")
+	host := flags.String("host", "localhost", "host running the mux")
+	if err := parseOptions(flags, args, 1); err != nil {
+		return err
 	}
-}	
+	if flags.NArg() != 1 {
+		return fmt.Errorf("give the channel to tail eg: nmea_mux tail --config ./config.yaml to_processor")
+	}
+	channel := flags.Arg(0)
 
-func getFloat32(current float32, data string, end int, e bool) (float32, bool){
-	l := len(data) + end
-	
-	if l > 0 {
-		//fmt.Printf("conv %s end %d\n", data[:l], end )
-		f64, err := strconv.ParseFloat(data[:l], 32)
-		if err != nil{
-			return current, false
+	n, err := loadMux("tail", []string{"--config", *config_path})
+	var errs nmea_mux.ConfigErrors
+	if err != nil && !errors.As(err, &errs) {
+		return err
+	}
+	port := ""
+	for _, name := range n.Config.TypeList["tcp_server"] {
+		values := n.Config.Values[name]
+		if len(values["tap"]) == 1 && values["tap"][0] == channel && len(values["port"]) == 1 {
+			port = values["port"][0]
 		}
-		return float32(f64), e
-	} 
-	return current, false
+	}
+	if port == "" {
+		return fmt.Errorf("no tcp_server taps %s - add a tcp_server with tap: %s to the config and restart the mux", channel, channel)
+	}
+
+	address := net.JoinHostPort(*host, port)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return fmt.Errorf("could not connect to the mux at %s, is it running? %w", address, err)
+	}
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fmt.Println(strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("the mux at %s closed the connection", address)
 }
@@ -3,9 +3,13 @@ package nmea_mux
 import (
 	//"fmt"
 	//"math"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
-	//"time"
+	"time"
 	"github.com/martinmarsh/nmea-mux/test_data"
 	"github.com/martinmarsh/nmea-mux/test_helpers"
 )
@@ -16,6 +20,45 @@ func (n *NmeaMux) mockProcess(name string) error {
 	return nil
 }
 
+// Returns a channel given the message of every record logged by the mux
+// devices, for tests to read as they did the monitor channel
+func captureMonitor(n *NmeaMux) chan string {
+	messages := make(chan string, 100)
+	n.AddLogHandler(&captureHandler{messages: messages})
+	return messages
+}
+
+type captureHandler struct {
+	messages chan string
+}
+
+func (h *captureHandler) Enabled(ctx context.Context, level slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	select {
+	case h.messages <- r.Message:
+	default:
+	}
+	return nil
+}
+
+func (h *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+
+func (h *captureHandler) WithGroup(name string) slog.Handler { return h }
+
+// Returns true if err only has channel wiring errors, as expected for
+// test configs whose channels are read and written by the test
+func onlyWiringErrors(err error) bool {
+	var errs ConfigErrors
+	if err == nil {
+		return true
+	}
+	if !errors.As(err, &errs) {
+		return false
+	}
+	return !errs.blocking()
+}
+
 func TestConfigLoaded(t *testing.T) {
 	n := NewMux()
 	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
@@ -73,30 +116,65 @@ func TestConfigBad(t *testing.T) {
 func TestConfigMoreInputs(t *testing.T) {
 	n := NewMux()
 	err := n.LoadConfig("./test_data/", "config_more_inputs", "yaml", test_data.Bad_more_inputs_config)
-	message := "config errors found: input channels and output channels must be wired together: check these channels"
-	if test_helpers.UnexpectedErrorMessage(message, err) {
-		t.Errorf("Config. Wrong error message on config channel matching: %s", err)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || !onlyWiringErrors(err) {
+		t.Fatalf("Config. Expected only channel wiring errors got: %s", err)
+	}
+	expected := ConfigError{Device: "bridge", Key: "input", Problem: "channel to_2000 is not an output of any device",
+		Fix: "add it to the outputs of a device or change the input", wiring: true}
+	if len(errs) != 5 || errs[0] != expected {
+		t.Errorf("Config. Wrong errors on config channel matching: %s", err)
 	}
 }
 
 func TestConfigMoreOutputs(t *testing.T) {
 	n := NewMux()
 	err := n.LoadConfig("./test_data/", "config_more_outputs", "yaml", test_data.Bad_more_outputs_config)
-	message := "config errors found: input channels and output channels must be wired together: check these channels"
+	message := "config errors found: ais outputs: channel to_2000 is not the input of any device - set it as the input of a device or remove it;"
 	if test_helpers.UnexpectedErrorMessage(message, err) {
 		t.Errorf("Config. Wrong error message on config channel matching: %s", err)
 	}
+	if !strings.Contains(err.Error(), "main_processor outputs: unknown setting") {
+		t.Errorf("Config. Processor outputs setting is not known: %s", err)
+	}
 }
 
 func TestConfigUnknownType(t *testing.T) {
 	n := NewMux()
 	err := n.LoadConfig("./test_data/", "config_more_outputs", "yaml", test_data.Unknown_device_config)
-	message := "config errors found: input channels and output channels must be wired together: check these channels to_processor, -Unknown device found: test_unknown_type -"
+	message := "config errors found: compass outputs: channel to_processor is not the input of any device - set it as the input of a device or remove it; compass type: unknown device type test_unknown_type - use one of channel, dedup,"
 	if test_helpers.UnexpectedErrorMessage(message, err) {
 		t.Errorf("Config. Wrong error message on config unknown type: %s", err)
 	}
 }
 
+func TestConfigSchema(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Schema_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	expected := []ConfigError{
+		{Device: "compass", Problem: "must have exactly 1 port name or a usb_vid, usb_pid or usb_serial setting"},
+		{Device: "compass", Key: "baud", Problem: "fast is not a whole number", Fix: "use digits only eg 4800 or auto"},
+		{Device: "compass", Key: "bauds", Problem: "unknown setting", Fix: "did you mean baud?"},
+		{Device: "compass_out", Key: "if", Problem: "esp_auto is not a condition",
+			Fix: "use a list of conditions of the form variable == value"},
+		{Device: "listen", Key: "port", Problem: "required setting is missing", Fix: "add a port setting"},
+		{Device: "udp_opencpn", Key: "server_address", Problem: "192.168.1.14 is not an address",
+			Fix: "use host:port eg 192.168.1.14:8011"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Config. Expected %d errors got %s", len(expected), err)
+	}
+	for i := range expected {
+		if errs[i] != expected[i] {
+			t.Errorf("Config. Expected %s got %s", expected[i], errs[i])
+		}
+	}
+}
+
 func TestMonitorNoUdp(t *testing.T) {
 	n := NewMux()
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
@@ -162,4 +240,118 @@ func TestRemoveBadTag(t *testing.T){
 	if rest != "my message" {
         t.Errorf("Message wong got %s", rest)
 	}
-}
\ No newline at end of file
+}
+func TestWaitToStopOnCancel(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	n.devices = make(map[string](device))
+	n.monitor_active = true
+	n.devices["test1"] = (*NmeaMux).mockProcess
+	ctx, cancel := context.WithCancel(context.Background())
+	n.RunContext(ctx)
+	stopped := make(chan bool)
+	go func() {
+		n.WaitToStop()
+		stopped <- true
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("WaitToStop did not return after context was cancelled")
+	}
+}
+
+func TestConfigFromReader(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfigFromReader(strings.NewReader(test_data.Reader_config), "yaml")
+	if !onlyWiringErrors(err) {
+		t.Errorf("Config from reader failed to load: %s", err)
+	}
+	if n.Config.TypeList["dedup"][0] != "reader_dedup" || n.Channels["to_reader_dedup"] == nil {
+		t.Errorf("Reader config not loaded got %v", n.Config.TypeList)
+	}
+	if err := NewMux().LoadConfigFromReader(strings.NewReader(test_data.Bad_config), "yaml"); err == nil {
+		t.Error("Bad config from reader must fail")
+	}
+}
+
+func TestConfigFromReaderTwice(t *testing.T) {
+	n := NewMux()
+	if err := n.LoadConfig("./test_data/", "config", "yaml"); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	n.LoadConfigFromReader(strings.NewReader(test_data.Dedup_config), "yaml")
+	err := n.LoadConfigFromReader(strings.NewReader(test_data.Reader_config), "yaml")
+	if !onlyWiringErrors(err) {
+		t.Errorf("Config from reader failed to load: %s", err)
+	}
+	// only the devices of the last load are kept
+	if len(n.Config.Index) != 1 || n.Config.Values["reader_dedup"] == nil {
+		t.Errorf("Expected only reader_dedup got %v", n.Config.TypeList)
+	}
+	// a reload must not bring back the config file of the first load
+	if file := n.settings.ConfigFileUsed(); file != "" {
+		t.Errorf("Reader config still uses the config file %s", file)
+	}
+}
+
+func TestConfigFromMap(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfigFromMap(map[string]any{
+		"Map_Dedup": map[string]any{
+			"type":    "dedup",
+			"input":   "to_map_dedup",
+			"window":  200,
+			"outputs": []string{"from_map_dedup"},
+		},
+	})
+	if !onlyWiringErrors(err) {
+		t.Errorf("Config from map failed to load: %s", err)
+	}
+	if n.Config.Values["map_dedup"]["window"][0] != "200" {
+		t.Errorf("Map config not loaded got %v", n.Config.Values)
+	}
+	if n.Config.Values["map_dedup"]["outputs"][0] != "from_map_dedup" {
+		t.Errorf("Map outputs not loaded got %v", n.Config.Values["map_dedup"])
+	}
+}
+
+func TestConfigPerMux(t *testing.T) {
+	first := NewMux()
+	second := NewMux()
+	first.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	second.LoadConfigFromReader(strings.NewReader(test_data.Reader_config), "yaml")
+	if len(first.Config.Index) != 12 || len(second.Config.Index) != 1 {
+		t.Errorf("Muxes share config got %d and %d devices", len(first.Config.Index), len(second.Config.Index))
+	}
+	if second.settings.IsSet("main_processor.type") {
+		t.Error("Second mux has settings from the first")
+	}
+}
+
+func TestLoadConfigSearchesOnlyItsDirectory(t *testing.T) {
+	n := NewMux()
+	if err := n.LoadConfig("./test_data/", "config", "yaml"); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	// a second load must not find config.yaml in the first directory
+	err := n.LoadConfig(t.TempDir(), "config", "yaml")
+	if err == nil || !strings.HasPrefix(err.Error(), "config file error - not found") {
+		t.Errorf("Expected config not found got %v", err)
+	}
+}
+
+// The configs shipped with the command and examples must pass the schema
+func TestShippedConfigsLoad(t *testing.T) {
+	for _, config := range []struct{ dir, name string }{
+		{"./nmea_mux/", "config"},
+		{"./example/", "config"},
+		{"./example/", "example_config"},
+	} {
+		n := NewMux()
+		if err := n.LoadConfig(config.dir, config.name, "yaml"); err != nil {
+			t.Errorf("%s%s.yaml failed to load: %s", config.dir, config.name, err)
+		}
+	}
+}
@@ -8,23 +8,30 @@ package nmea_mux
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/martinmarsh/nmea0183"
+	"github.com/spf13/viper"
 )
 
+// Muxes with the same config directory must not write the default
+// sentence definitions file at the same time
+var sentences_mu sync.Mutex
+
 type ProcessInterfacer interface {
 	parse_make_sentence(m_config map[string][]string, make_name string) string
-	runner(string)
+	runner(context.Context, string)
 	fileLogger(string)
-	makeSentence(name string)
+	makeSentence(ctx context.Context, name string)
 	GetNmeaHandle() *NmeaHandle
 	GetData(tag string) map[string]string
 	PutData(data map[string]string)
@@ -60,23 +67,61 @@ type Processor struct {
 	add_now_var		string
 	channels        *map[string](chan string)
 	writer          *bufio.Writer
+	file            *os.File
 	file_closed     bool
-	monitor_channel *chan string
-	monitor_report  []string
+	log             *slog.Logger
+	checksum        *checksumFilter
+	stats           *deviceStats
+	make_stats      map[string](*deviceStats) // by make sentence name
+	log_bytes       atomic.Int64              // size of the open ships log
 }
 
 
 func (n *NmeaMux) nmeaProcessorProcess(name string) error {
 	var Sentences nmea0183.Sentences
 	process := n.newProcessor(&Sentences)
+	n.processors_mu.Lock()
 	n.Processors[name] = process
+	n.processors_mu.Unlock()
 	return n.nmeaProcessorConfig(name, process, &Sentences)
 }
 
+// Returns the named processor. Use this rather than the Processors map
+// while running as a processor is replaced when its config is reloaded.
+func (n *NmeaMux) Processor(name string) ProcessInterfacer {
+	n.processors_mu.Lock()
+	defer n.processors_mu.Unlock()
+	return n.Processors[name]
+}
+
+// Loads the sentence definitions in nmea_sentences.yaml from config_dir,
+// writing the defaults to it if it cannot be read. A viper of its own is
+// used, not the global one used by nmea0183 Load, so that each mux has the
+// definitions from its own config directory.
+func loadSentences(config_dir string) (*nmea0183.Sentences, error) {
+	sentences_mu.Lock()
+	defer sentences_mu.Unlock()
+	definitions := viper.New()
+	definitions.SetConfigName("nmea_sentences")
+	definitions.SetConfigType("yaml")
+	definitions.AddConfigPath(config_dir)
+	err := definitions.ReadInConfig()
+	if err != nil {
+		definitions.SetDefault("formats", nmea0183.GetDefaultFormats())
+		definitions.SetDefault("variables", nmea0183.GetDefaultVars())
+		// does not overwrite a file which could not be read
+		definitions.SafeWriteConfig()
+	}
+	return nmea0183.MakeSentences(definitions.GetStringMapStringSlice("formats"),
+		definitions.GetStringMapString("variables")), err
+}
+
 func (n *NmeaMux) nmeaProcessorConfig(name string, process *Processor, Sentences *nmea0183.Sentences) error {
+	log := n.deviceLogger(name)
 	config := n.Config.Values[name]
 	error_str := ""
 
+	process.log = log
 	process.add_now_var = ""
 	if add_now_var, found := config["add_now_var"]; found {
 		if len(add_now_var) == 1 {
@@ -115,10 +160,12 @@ func (n *NmeaMux) nmeaProcessorConfig(name string, process *Processor, Sentences
 		process.date_time_var = append(process.date_time_var, "datetime")
 	}
 
-	if err := Sentences.Load(); err != nil {
+	// sentence definitions are kept with the mux config
+	loaded, err := loadSentences(n.config_dir)
+	if err != nil {
 		error_str += "Could not load Nmea sentence config. A default was created;"
-		Sentences.SaveLoadDefault()
 	}
+	*Sentences = *loaded
 
 	//process.NmeaHandle.Nmea = Sentences.MakeHandle()
 
@@ -152,33 +199,37 @@ func (n *NmeaMux) nmeaProcessorConfig(name string, process *Processor, Sentences
 
 			ok_to_pass := true
 
-			if processor, found := m_config["processor"]; found {
-				if len(processor) > 1 {
+			if processor, found := makeSentenceProcessor(m_config); found {
+				if len(m_config["processor"]) > 1 {
 					error_str += fmt.Sprintf("make sentence %s only 1st processor listed is used rest ignored;", make_name)
 				}
-				if processor[0] != name {
+				if processor != name {
 					ok_to_pass = false //belongs to another process so ignore
 				}
-			} else if len(n.Config.TypeList["processor"]) != 1 {
+			} else {
 				error_str += fmt.Sprintf("Make sentence %s needs to be associated with a processor - add a processor setting;", make_name)
 				ok_to_pass = false
 			}
 
 			if ok_to_pass {
 				error_str += process.parse_make_sentence(m_config, make_name)
+				process.make_stats[make_name] = n.deviceStats(make_name)
 			}
 		}
 	}
 
-	process.channels = &n.Channels
+	process.channels = n.deviceChannels(name)
+	process.checksum = n.newChecksumFilter(name)
+	process.stats = n.deviceStats(name)
 
 	if len(error_str) > 0 {
-		(n.Monitor_channel) <- fmt.Sprintf("Processor <%s> Errors: %s", name, error_str)
+		log.Error(fmt.Sprintf("Processor <%s> Errors: %s", name, error_str))
 		return fmt.Errorf("Processor %s/make sentence has these errors:%s", name, error_str)
 	}
 
-	go process.runner(name) //allows mock testing by injection of process_device dependency
-	(n.Monitor_channel) <- fmt.Sprintf("Processor %s started", name)
+	//allows mock testing by injection of process_device dependency
+	n.goDevice(name, func(ctx context.Context) { process.runner(ctx, name) })
+	log.Info(fmt.Sprintf("Processor %s started", name))
 
 	return nil;
 }
@@ -205,6 +256,26 @@ func (p *Processor) PutData(data map[string]string) {
 }
 
 
+// Parses a make sentence condition of the form variable == value
+// Returns the processor which runs a make_sentence, the first in its processor
+// setting. There is no default even with one processor so that the graph and
+// reload agree with the processor about which make_sentences run.
+func makeSentenceProcessor(config map[string][]string) (string, bool) {
+	if processors := config["processor"]; len(processors) > 0 && processors[0] != "" {
+		return processors[0], true
+	}
+	return "", false
+}
+
+func parseCondition(str string) (compare, bool) {
+	variable, constant, found := strings.Cut(str, "==")
+	c := compare{
+		variable: strings.TrimSpace(variable),
+		constant: strings.TrimSpace(constant),
+	}
+	return c, found && c.variable != "" && c.constant != ""
+}
+
 func (p *Processor) parse_make_sentence(m_config map[string][]string, make_name string) string {
 	def := sentence_def{
 		sentence:        "",
@@ -232,13 +303,11 @@ func (p *Processor) parse_make_sentence(m_config map[string][]string, make_name
 			case "else_origin_tag":
 				def.else_origin_tag = val
 			case "if":
-				def.conditional = make([]compare, 1)
-				z := strings.Split(val, "==")
-				c := compare{
-					variable: strings.TrimSpace(z[0]),
-					constant: strings.TrimSpace(z[1]),
+				if c, ok := parseCondition(val); ok {
+					def.conditional = []compare{c}
+				} else {
+					error_str += fmt.Sprintf("Condition %s in %s must be variable == value;", val, make_name)
 				}
-				def.conditional[0] = c
 
 			case "prefix":
 				def.prefix = val
@@ -254,15 +323,13 @@ func (p *Processor) parse_make_sentence(m_config map[string][]string, make_name
 		} else {
 			switch i {
 			case "if":
-				def.conditional = make([]compare, len(v))
-				for i, y := range v {
-
-					z := strings.Split(y, "==")
-					c := compare{
-						variable: strings.TrimSpace(z[0]),
-						constant: strings.TrimSpace(z[1]),
+				def.conditional = make([]compare, 0, len(v))
+				for _, y := range v {
+					if c, ok := parseCondition(y); ok {
+						def.conditional = append(def.conditional, c)
+					} else {
+						error_str += fmt.Sprintf("Condition %s in %s must be variable == value;", y, make_name)
 					}
-					def.conditional[i] = c
 				}
 			case "outputs":
 				def.outputs = v
@@ -280,15 +347,15 @@ func (n *NmeaMux) newProcessor(Sentences  *nmea0183.Sentences) *Processor {
 	return &Processor{
 		definitions:     make(map[string]sentence_def),
 		every:           make(map[string]int),
-		monitor_channel: &n.Monitor_channel,
-		monitor_report:  n.monitor_report,
+		make_stats:      make(map[string](*deviceStats)),
+		log:             n.logger,
 		NmeaHandle:      &NmeaHandle{
 			Nmea:    Sentences.MakeHandle(),
 		},
 	}
 }
 
-func (p *Processor) runner(name string) {
+func (p *Processor) runner(ctx context.Context, name string) {
 	countdowns := make(map[string]int)
 	log_ticker := time.NewTicker(10 * time.Second)
 	if p.log_period > 0 {
@@ -305,17 +372,19 @@ func (p *Processor) runner(name string) {
 	for m_name, every := range p.every {
 		countdowns[m_name] = every
 	}
-	*(p.monitor_channel) <- fmt.Sprintf("Runner %s started- log %ds", name, p.log_period)
+	p.log.Info(fmt.Sprintf("Runner %s started- log %ds", name, p.log_period))
 	sleep_for := 10 * time.Millisecond
 	for {
 		select {
+		case <-ctx.Done():
+			p.closeLog(name)
+			p.log.Info(fmt.Sprintf("Runner %s stopped", name))
+			return
 		case str := <-(*p.channels)[p.input]:
-			report := false
-			if slices.Contains(p.monitor_report, "parse"){
-				report = true
-			}
-			if err := parse(str, p.NmeaHandle, p.monitor_channel, report); err != nil {
-				*(p.monitor_channel) <- fmt.Sprintf("Nmea parsing error %s", err)
+			p.stats.received(str)
+			if err := parse(str, p.NmeaHandle, p.checksum, p.log); err != nil {
+				p.log.Warn(fmt.Sprintf("Nmea parsing error %s", err))
+				p.stats.parseError()
 			}
 			sleep_for = 0
 		case <-log_ticker.C:
@@ -326,7 +395,7 @@ func (p *Processor) runner(name string) {
 				countdowns[m_name] -= 100
 				if countdowns[m_name] <= 0 {
 					countdowns[m_name] = every
-					p.makeSentence(m_name)
+					p.makeSentence(ctx, m_name)
 				}
 			}
 			sleep_for = 0
@@ -337,7 +406,7 @@ func (p *Processor) runner(name string) {
 	}
 }
 
-func (p *Processor) makeSentence(name string) {
+func (p *Processor) makeSentence(ctx context.Context, name string) {
 	pn := p.definitions[name]
 	manCode := pn.prefix
 	sentence_name := pn.sentence
@@ -368,10 +437,8 @@ func (p *Processor) makeSentence(name string) {
 	for _, var_tag := range try_list {
 		if str, err := p.NmeaHandle.Nmea.WriteSentencePrefixVar(manCode, sentence_name, var_tag); err == nil {
 			for _, v := range pn.outputs {
-				select {
-    				case ((*p.channels)[v]) <- str:
-    				default:
-						fmt.Println("In Make Sentence", name, "message '", str, "' could not be put on", v , "channel - may be full")
+				if !p.make_stats[name].send(ctx, (*p.channels)[v], str) {
+					p.log.Warn("Sentence could not be put on channel - may be full", "make_sentence", name, "channel", v, "sentence", str)
 				}
 			}
 			break
@@ -401,15 +468,17 @@ func (p *Processor) fileLogger(name string) {
 
 		if len(file_name) > 0 {
 			if f, err := os.Create(file_name); err == nil {
+				p.file = f
 				p.writer = bufio.NewWriter(f)
 				p.file_closed = false
+				p.log_bytes.Store(0)
 			} else {
-				*(p.monitor_channel) <- fmt.Sprintf("Log %s Error on file open: ", name)
+				p.log.Error(fmt.Sprintf("Log %s Error on file open: ", name))
 				time.Sleep(time.Minute)
 				p.file_closed = true
 			}
 		} else {
-			*(p.monitor_channel) <- fmt.Sprintf("Log %s waiting for datetime : ", name)
+			p.log.Warn(fmt.Sprintf("Log %s waiting for datetime : ", name))
 		}
 
 	} else {
@@ -417,38 +486,55 @@ func (p *Processor) fileLogger(name string) {
 		rec_str := fmt.Sprintf("%s\n", string(data_json))
 
 		if _, err := p.writer.WriteString(rec_str); err != nil {
-			*(p.monitor_channel) <- fmt.Sprintf("Log %s Error on write: ", name)
+			p.log.Error(fmt.Sprintf("Log %s Error on write: ", name))
 			p.writer.Flush()
 		} else {
-			if slices.Contains(p.monitor_report, "data_log"){
-				*(p.monitor_channel) <- fmt.Sprintf("Data Logged: %s", rec_str)
-			}
-	
+			p.log_bytes.Add(int64(len(rec_str)))
+			p.log.Debug(fmt.Sprintf("Data Logged: %s", rec_str), "category", category_data_log)
 		}
 	}
 
 }
 
+// Flushes and closes the ships log if open
+func (p *Processor) closeLog(name string) {
+	if p.file_closed || p.writer == nil {
+		return
+	}
+	if err := p.writer.Flush(); err != nil {
+		p.log.Error(fmt.Sprintf("Log %s Error on flush: %s", name, err))
+	}
+	if err := p.file.Close(); err != nil {
+		p.log.Error(fmt.Sprintf("Log %s Error on close: %s", name, err))
+	}
+	p.file_closed = true
+}
+
 func (p *Processor) GetNmeaHandle() *NmeaHandle {
 	return p.NmeaHandle
 }
 
-func parse(str string, handle *NmeaHandle, monitor_channel *chan string, report bool) error {
+func parse(str string, handle *NmeaHandle, checksum *checksumFilter, log *slog.Logger) error {
 	tag := ""
 
 	defer func() {
 		if r := recover(); r != nil {
 			str = ""
-			*monitor_channel <- "** Recover from NMEA Panic **"
+			log.Error("** Recover from NMEA Panic **")
 		}
 	}()
 
 	tag, str = trim_tag(str)
 
 	if len(str) > 5 && len(str) < 89 && str[0] == '$' {
-		if report {
-			*monitor_channel <- fmt.Sprintf("Parsing: %s from tag %s", str, tag)
+		// never store garbage from a corrupt sentence
+		if _, valid := checkSentence(str); !valid {
+			return fmt.Errorf("corrupt sentence tagged: %s in %q", tag, str)
+		}
+		if _, ok := checksum.filter(str); !ok {
+			return fmt.Errorf("no checksum tagged: %s in %s", tag, str)
 		}
+		log.Debug(fmt.Sprintf("Parsing: %s from tag %s", str, tag), "category", category_parse)
 		handle.Nmea_mu.Lock()
     	defer handle.Nmea_mu.Unlock()
 		_, _, error := handle.Nmea.ParsePrefixVar(str, tag)
@@ -6,6 +6,9 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package nmea_mux
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,7 +22,7 @@ type mockProcess struct {
 	name   string
 }
 
-func (m *mockProcess) runner(n string) {
+func (m *mockProcess) runner(ctx context.Context, n string) {
 	m.called = true
 	m.name = n
 }
@@ -27,8 +30,8 @@ func (m *mockProcess) runner(n string) {
 func (m *mockProcess) parse_make_sentence(map[string][]string, string) string {
 	return ""
 }
-func (m *mockProcess) fileLogger(string)   {}
-func (m *mockProcess) makeSentence(string) {}
+func (m *mockProcess) fileLogger(string)                    {}
+func (m *mockProcess) makeSentence(context.Context, string) {}
 func (m *mockProcess) newProcessor() *Processor {
 	return &Processor{
 		definitions: make(map[string]sentence_def),
@@ -38,6 +41,7 @@ func (m *mockProcess) newProcessor() *Processor {
 
 func TestProcessor(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	var sentences nmea0183.Sentences
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	name := "main_processor"
@@ -47,7 +51,7 @@ func TestProcessor(t *testing.T) {
 	if err != nil {
 		t.Errorf("error returned %s", err)
 	}
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"Processor main_processor started",
 	}
@@ -59,6 +63,7 @@ func TestProcessor(t *testing.T) {
 
 func TestProcessorConfig(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	var sentences nmea0183.Sentences
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	name := "main_processor"
@@ -68,9 +73,9 @@ func TestProcessorConfig(t *testing.T) {
 		t.Errorf("Processor Config Error %s", err)
 	}
 
-	go process.runner(name)
+	go process.runner(context.Background(), name)
 
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"Processor main_processor started",
 		"Runner main_processor started- log 1s",
@@ -153,7 +158,7 @@ func TestProcessorConfig(t *testing.T) {
 
 	time.Sleep(2100 * time.Millisecond)
 
-	messages = test_helpers.GetMessages(n.Monitor_channel)
+	messages = test_helpers.GetMessages(monitor)
 
 	expected_messages = []string{
 		"Log main_processor waiting for datetime",
@@ -171,7 +176,7 @@ func TestProcessorConfig(t *testing.T) {
 
 	process.NmeaHandle.Nmea.Update(map[string]string{"esp_compass_status": "3333"})
 
-	go process.makeSentence("compass_out")
+	go process.makeSentence(context.Background(), "compass_out")
 	compass_messages := test_helpers.GetMessages(n.Channels["to_2000"])
 
 	if compass_messages[0] != "$HFHDM,200.5,M*2B" {
@@ -179,10 +184,59 @@ func TestProcessorConfig(t *testing.T) {
 	}
 	process.NmeaHandle.Nmea.Update(map[string]string{"esp_auto": "1"})
 
-	go process.makeSentence("compass_out")
+	go process.makeSentence(context.Background(), "compass_out")
 	compass_messages = test_helpers.GetMessages(n.Channels["to_2000"])
 	if compass_messages[0] != "$HFHDM,100.5,M*28" {
 		t.Error("wrong compass message")
 	}
 
 }
+
+func TestMakeSentenceBadCondition(t *testing.T) {
+	n := NewMux()
+	var sentences nmea0183.Sentences
+	process := n.newProcessor(&sentences)
+	error_str := process.parse_make_sentence(map[string][]string{
+		"sentence": {"hdm"},
+		"if":       {"esp_auto", "==", "1"},
+	}, "compass_out")
+	if error_str != "Condition esp_auto in compass_out must be variable == value;Condition == in compass_out must be variable == value;Condition 1 in compass_out must be variable == value;" {
+		t.Errorf("Expected condition errors got %s", error_str)
+	}
+	if error_str := process.parse_make_sentence(map[string][]string{"if": {"esp_auto == 1"}}, "auto_out"); error_str != "" {
+		t.Errorf("Unexpected error %s", error_str)
+	}
+	if c := process.definitions["auto_out"].conditional[0]; c.variable != "esp_auto" || c.constant != "1" {
+		t.Errorf("Condition not parsed got %v", c)
+	}
+}
+
+func TestSentencesLoadedPerConfigDir(t *testing.T) {
+	hdm_dir := t.TempDir()
+	dpt_dir := t.TempDir()
+	os.WriteFile(filepath.Join(hdm_dir, "nmea_sentences.yaml"),
+		[]byte("formats:\n  hdm: [hdm]\nvariables:\n  hdm: x.x\n"), 0644)
+	os.WriteFile(filepath.Join(dpt_dir, "nmea_sentences.yaml"),
+		[]byte("formats:\n  dpt: [dbt, toff]\nvariables:\n  dbt: x.x\n  toff: x.x\n"), 0644)
+
+	for _, test := range []struct {
+		dir     string
+		known   string
+		unknown string
+	}{
+		{hdm_dir, "$HCHDM,200.5,M", "$SDDPT,5.2,0.5"},
+		{dpt_dir, "$SDDPT,5.2,0.5", "$HCHDM,200.5,M"},
+	} {
+		sentences, err := loadSentences(test.dir)
+		if err != nil {
+			t.Fatalf("Could not load sentences from %s: %s", test.dir, err)
+		}
+		handle := sentences.MakeHandle()
+		if results, _, _, _ := handle.ParseToMap(test.known); len(results) == 0 {
+			t.Errorf("Expected %s to be defined in %s", test.known, test.dir)
+		}
+		if results, _, _, _ := handle.ParseToMap(test.unknown); len(results) != 0 {
+			t.Errorf("Expected %s not to be defined in %s got %v", test.unknown, test.dir, results)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// A device provided by another package and registered with RegisterDeviceType.
+// Run must return once ctx is done, the mux waits for it on shutdown.
+type Device interface {
+	Run(ctx context.Context) error
+}
+
+// Optionally implemented by a Device to report its health, nil when healthy
+type HealthReporter interface {
+	Health() error
+}
+
+// Everything a registered device is given when the mux starts it
+type DeviceEnv struct {
+	Name     string
+	Config   map[string][]string // settings from the config as for built in devices
+	Input    string
+	Outputs  []string
+	Channels map[string](chan string) // every channel in the config by name
+	Monitor  chan<- string            // messages are logged at info level
+	Logger   *slog.Logger             // with the device name attribute
+}
+
+// Makes a device from its settings. Returning an error stops the device
+// starting, the error is reported on the monitor.
+type DeviceFactory func(env DeviceEnv) (Device, error)
+
+var builtin_device_types = []string{
+	"serial", "udp_client", "nmea_processor", "udp_listen", "tcp_server", "tcp_client", "recorder",
+	"player", "filter", "throttle", "rewrite", "dedup", "make_sentence", "monitor", "metrics", "channel", "external",
+}
+
+var (
+	device_types    = make(map[string]DeviceFactory)
+	device_types_mu sync.Mutex
+)
+
+// Registers a device type so that config sections with this type are made
+// by factory and run by the mux like built in devices. Register before
+// loading a config which uses it.
+func RegisterDeviceType(name string, factory DeviceFactory) error {
+	device_types_mu.Lock()
+	defer device_types_mu.Unlock()
+	if slices.Contains(builtin_device_types, name) {
+		return fmt.Errorf("device type %s is built in and cannot be registered", name)
+	}
+	if _, found := device_types[name]; found {
+		return fmt.Errorf("device type %s is already registered", name)
+	}
+	if factory == nil {
+		return fmt.Errorf("device type %s has no factory", name)
+	}
+	device_types[name] = factory
+	return nil
+}
+
+func registeredDeviceType(name string) (DeviceFactory, bool) {
+	device_types_mu.Lock()
+	defer device_types_mu.Unlock()
+	factory, found := device_types[name]
+	return factory, found
+}
+
+func customDevice(factory DeviceFactory) device {
+	return func(n *NmeaMux, name string) error {
+		return n.customProcess(name, factory)
+	}
+}
+
+func (n *NmeaMux) customProcess(name string, factory DeviceFactory) error {
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	env := DeviceEnv{
+		Name:     name,
+		Config:   config,
+		Outputs:  config["outputs"],
+		Channels: *n.deviceChannels(name),
+		Monitor:  n.Monitor_channel,
+		Logger:   log,
+	}
+	if inputs, found := config["input"]; found && len(inputs) > 0 {
+		env.Input = inputs[0]
+	}
+
+	dev, err := factory(env)
+	if err != nil {
+		log.Error(fmt.Sprintf("Device %s Errors: %s", name, err))
+		return fmt.Errorf("device %s has these errors:%s", name, err)
+	}
+
+	run := n.deviceRunState(name)
+	n.running_mu.Lock()
+	run.device = dev
+	n.running_mu.Unlock()
+	log.Info(fmt.Sprintf("Started %s device %s", configType(config), name))
+	n.goDevice(name, func(ctx context.Context) {
+		if err := dev.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Error(fmt.Sprintf("Device %s stopped with error: %s", name, err))
+		}
+	})
+	return nil
+}
+
+// Returns the health of every device started by the mux, nil if it is
+// running normally. Registered devices may report their own health.
+func (n *NmeaMux) Health() map[string]error {
+	n.running_mu.Lock()
+	defer n.running_mu.Unlock()
+	health := make(map[string]error, len(n.running))
+	for name, run := range n.running {
+		switch {
+		case run.ctx.Err() != nil:
+			health[name] = fmt.Errorf("stopped")
+		case run.active.Load() == 0:
+			health[name] = fmt.Errorf("not running")
+		default:
+			health[name] = nil
+			if reporter, ok := run.device.(HealthReporter); ok {
+				health[name] = reporter.Health()
+			}
+		}
+	}
+	return health
+}
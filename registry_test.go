@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+type echoDevice struct {
+	env     DeviceEnv
+	prefix  string
+	stopped chan bool
+}
+
+func (e *echoDevice) Run(ctx context.Context) error {
+	defer close(e.stopped)
+	for {
+		select {
+		case str := <-e.env.Channels[e.env.Input]:
+			for _, out := range e.env.Outputs {
+				e.env.Channels[out] <- e.prefix + str
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (e *echoDevice) Health() error {
+	return fmt.Errorf("echo is tired")
+}
+
+func TestRegisterDeviceType(t *testing.T) {
+	var echo *echoDevice
+	err := RegisterDeviceType("test_echo", func(env DeviceEnv) (Device, error) {
+		if len(env.Config["prefix"]) != 1 {
+			return nil, fmt.Errorf("prefix must be set")
+		}
+		echo = &echoDevice{env: env, prefix: env.Config["prefix"][0], stopped: make(chan bool)}
+		return echo, nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := RegisterDeviceType("test_echo", nil); err == nil {
+		t.Error("Registering a type twice must fail")
+	}
+	if err := RegisterDeviceType("serial", nil); err == nil {
+		t.Error("Registering a built in type must fail")
+	}
+
+	n := NewMux()
+	monitor := captureMonitor(n)
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Registry_config); !onlyWiringErrors(err) {
+		t.Errorf("Config with registered type failed to load: %s", err)
+	}
+	n.monitor_active = true
+	n.RunContext(context.Background())
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Started test_echo device my_echo", "Device bad_echo Errors: prefix must be set"}, messages); not_found {
+		t.Errorf("Expected start and factory error messages got %v", messages)
+	}
+
+	n.Channels["to_echo"] <- "$IIDPT,5.2,0.5*42"
+	if received := test_helpers.GetMessages(n.Channels["from_echo"]); len(received) != 1 || received[0] != "echoed_$IIDPT,5.2,0.5*42" {
+		t.Errorf("Registered device did not run got %v", received)
+	}
+	if health := n.Health(); health["my_echo"] == nil || health["my_echo"].Error() != "echo is tired" {
+		t.Errorf("Expected health from device got %v", health)
+	}
+
+	n.Shutdown(context.Background())
+	select {
+	case <-echo.stopped:
+	default:
+		t.Error("Registered device was not stopped on shutdown")
+	}
+}
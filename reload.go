@@ -0,0 +1,164 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watches the config file read by LoadConfig and reloads it when it is saved
+func (n *NmeaMux) WatchConfig() {
+	n.settings.OnConfigChange(func(e fsnotify.Event) {
+		n.logger.Info(fmt.Sprintf("Config file %s changed", e.Name))
+		if err := n.ReloadConfig(); err != nil {
+			n.logger.Error(fmt.Sprintf("Config reload %s", err))
+		}
+	})
+	n.settings.WatchConfig()
+}
+
+// Compares the config last read by the mux settings with the running config then
+// stops, starts or restarts only the devices whose settings have changed.
+// Devices with unchanged settings, eg serial ports, carry on streaming.
+// A config with errors other than channel wiring is not applied.
+func (n *NmeaMux) ReloadConfig() error {
+	n.reload_mu.Lock()
+	defer n.reload_mu.Unlock()
+
+	config := newConfigData()
+	collectConfig(n.settings, config)
+	errs := validateConfig(config)
+	if errs.blocking() {
+		return errs
+	}
+	old := n.Config
+
+	changed := make(map[string]bool)
+	for name, values := range config.Values {
+		if !reflect.DeepEqual(values, old.Values[name]) {
+			changed[name] = true
+		}
+	}
+	for name := range old.Values {
+		if _, found := config.Values[name]; !found {
+			changed[name] = true
+		}
+	}
+
+	// make sentences are run by their processor so it must restart instead
+	for name := range changed {
+		for _, c := range []*configData{old, config} {
+			values, found := c.Values[name]
+			if !found || configType(values) != "make_sentence" {
+				continue
+			}
+			if processor, found := makeSentenceProcessor(values); found {
+				if _, found := config.Values[processor]; found {
+					changed[processor] = true
+				}
+			}
+		}
+	}
+
+	if len(changed) == 0 {
+		n.logger.Info("Config reload found no changes")
+		return nil
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	restarting := make(map[string]bool)
+	for _, name := range names {
+		if configType(old.Values[name]) == "monitor" {
+			continue
+		}
+		if _, found := n.devices[name]; found {
+			n.stopDevice(name)
+			delete(n.devices, name)
+			restarting[name] = true
+		}
+		delete(n.ExternalDevices, name)
+	}
+
+	// device go routines look up their input in Config while starting
+	n.channels_mu.Lock()
+	n.Config = config
+	n.channels_mu.Unlock()
+	n.makeChannels()
+	err_str := ""
+
+	for _, name := range names {
+		values, found := config.Values[name]
+		device_type := configType(values)
+		switch {
+		case !found:
+			if restarting[name] {
+				n.logger.Info(fmt.Sprintf("Config reload stopped %s", name), "device", name)
+			}
+			continue
+		case device_type == "make_sentence":
+			n.logger.Info(fmt.Sprintf("Config reload changed make sentence %s", name), "device", name)
+			continue
+		case device_type == "channel":
+			n.logger.Info(fmt.Sprintf("Config reload changed channel %s", name), "device", name)
+			continue
+		case device_type == "monitor":
+			n.logger.Warn(fmt.Sprintf("Config reload monitor %s changes need a restart of the mux", name), "device", name)
+			continue
+		}
+
+		n.addDevice(device_type, name)
+		if device_type == "external" {
+			n.logger.Info(fmt.Sprintf("Config reload changed external device %s", name), "device", name)
+			continue
+		}
+		if device_method, found := n.devices[name]; found {
+			if err := n.RunDevice(name, device_method); err != nil {
+				err_str += fmt.Sprintf("%s -", err)
+			}
+			if restarting[name] {
+				n.logger.Info(fmt.Sprintf("Config reload restarted %s", name), "device", name)
+			} else {
+				n.logger.Info(fmt.Sprintf("Config reload started %s", name), "device", name)
+			}
+		}
+	}
+
+	if err_str != "" {
+		return fmt.Errorf("config reload devices failed to start: %s", err_str)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Stops the go routines of the named device and waits for them to exit
+func (n *NmeaMux) stopDevice(name string) {
+	n.running_mu.Lock()
+	run, found := n.running[name]
+	delete(n.running, name)
+	n.running_mu.Unlock()
+	if found {
+		run.cancel()
+		run.wg.Wait()
+	}
+}
+
+func configType(values map[string][]string) string {
+	if types, found := values["type"]; found && len(types) > 0 {
+		return types[0]
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestReloadConfig(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	// the output channels are read by the test so are not wired to devices
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Reload_config)
+	n.monitor_active = true
+	n.RunContext(context.Background())
+	defer n.Shutdown(context.Background())
+	test_helpers.GetMessages(monitor)
+	steady := n.running["steady_dedup"]
+	changing := n.running["changing_dedup"]
+
+	n.settings.ReadConfig(strings.NewReader(test_data.Reloaded_config))
+	if err := n.ReloadConfig(); !onlyWiringErrors(err) {
+		t.Errorf("Reload failed: %s", err)
+	}
+	messages := test_helpers.GetMessages(monitor)
+	expected := []string{
+		"Config reload stopped removed_dedup",
+		"Config reload started added_dedup",
+		"Config reload restarted changing_dedup",
+	}
+	if i, _, not_found, _ := test_helpers.MessagesIn(expected, messages); not_found {
+		t.Errorf("Expected %s in %v", expected[i], messages)
+	}
+	if len(messages) != 5 {
+		t.Errorf("Unchanged devices must not be restarted got %v", messages)
+	}
+
+	if n.running["steady_dedup"] != steady {
+		t.Error("steady_dedup was restarted")
+	}
+	if n.running["changing_dedup"] == changing {
+		t.Error("changing_dedup was not restarted")
+	}
+	if _, found := n.running["removed_dedup"]; found {
+		t.Error("removed_dedup is still running")
+	}
+
+	n.Channels["to_added"] <- "$IIDPT,5.2,0.5*42"
+	n.Channels["to_steady"] <- "$IIDPT,5.2,0.5*42"
+	if received := test_helpers.GetMessages(n.Channels["from_added"]); len(received) != 1 {
+		t.Errorf("Added device did not forward got %v", received)
+	}
+	if received := test_helpers.GetMessages(n.Channels["from_steady"]); len(received) != 1 {
+		t.Errorf("Steady device did not forward got %v", received)
+	}
+}
+
+func TestReloadMakeSentenceRestartsProcessor(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	n.devices = make(map[string](device))
+	n.devices["main_processor"] = (*NmeaMux).mockProcess
+	n.monitor_active = true
+
+	changed := strings.Replace(test_data.Good_config, "every: 15", "every: 30", 1)
+	if changed == test_data.Good_config {
+		t.Fatal("Test config has no make sentence every setting to change")
+	}
+	n.settings.ReadConfig(strings.NewReader(changed))
+	n.ReloadConfig()
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Config reload restarted main_processor"}, messages); not_found {
+		t.Errorf("Processor not restarted for make sentence change got %v", messages)
+	}
+}
+
+func TestReloadMakeSentenceWithoutProcessor(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	config := strings.Replace(test_data.Good_config, "processor: main_processor\n    sentence: rms", "sentence: rms", 1)
+	if config == test_data.Good_config {
+		t.Fatal("Test config has no rms make sentence to remove the processor from")
+	}
+	n.LoadConfig("./test_data/", "config", "yaml", config)
+	n.devices = make(map[string](device))
+	n.devices["main_processor"] = (*NmeaMux).mockProcess
+	n.monitor_active = true
+
+	// the make sentence is not run by any processor so none is restarted
+	n.settings.ReadConfig(strings.NewReader(strings.Replace(config, "every: 15", "every: 30", 1)))
+	n.ReloadConfig()
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Config reload restarted main_processor"}, messages); !not_found {
+		t.Errorf("Processor restarted for a make sentence it does not run got %v", messages)
+	}
+}
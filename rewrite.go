@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A rewrite rule applies to sentences matching its match setting which may be
+// a talker ID eg II, a sentence type eg HDG, a full address eg IIHDG or * for all
+type rewriteRule struct {
+	name         string
+	match        string
+	talker       string
+	sentence     string
+	strip_fields []int // 1 is the first field after the address
+	add_fields   []string
+}
+
+func (r *rewriteRule) matches(talker string, sentence_type string) bool {
+	switch {
+	case r.match == "*":
+		return true
+	case len(r.match) == 2:
+		return talker == r.match
+	case len(r.match) == 3:
+		return sentence_type == r.match
+	default:
+		return talker+sentence_type == r.match
+	}
+}
+
+// Returns the rewritten sentence with a new checksum. str must be untagged.
+func (r *rewriteRule) apply(str string) string {
+	talker, sentence_type := sentenceAddress(str)
+	if star := strings.LastIndexByte(str, '*'); star > 0 {
+		str = str[:star]
+	}
+	fields := strings.Split(str, ",")
+	if r.talker != "" {
+		talker = r.talker
+	}
+	if r.sentence != "" {
+		sentence_type = r.sentence
+	}
+	out := []string{str[:1] + talker + sentence_type}
+	for i, field := range fields[1:] {
+		if !slices.Contains(r.strip_fields, i+1) {
+			out = append(out, field)
+		}
+	}
+	out = append(out, r.add_fields...)
+	sentence := strings.Join(out, ",")
+	return fmt.Sprintf("%s*%s", sentence, nmeaChecksum(sentence))
+}
+
+// Finds rules in config keys of the form rules.<rule name>.<setting>
+func parseRewriteRules(config map[string][]string) ([]*rewriteRule, string) {
+	error_str := ""
+	by_name := make(map[string]*rewriteRule)
+	for key, values := range config {
+		parts := strings.Split(key, ".")
+		if parts[0] != "rules" {
+			continue
+		}
+		if len(parts) != 3 {
+			error_str += fmt.Sprintf("rule setting %s must be rules.<name>.<setting>;", key)
+			continue
+		}
+		rule, found := by_name[parts[1]]
+		if !found {
+			rule = &rewriteRule{name: parts[1]}
+			by_name[parts[1]] = rule
+		}
+		if len(values) == 0 {
+			error_str += fmt.Sprintf("rule %s %s has no value;", rule.name, parts[2])
+			continue
+		}
+		switch parts[2] {
+		case "match":
+			rule.match = strings.ToUpper(values[0])
+		case "talker":
+			rule.talker = strings.ToUpper(values[0])
+		case "sentence":
+			rule.sentence = strings.ToUpper(values[0])
+		case "strip_fields":
+			for _, v := range values {
+				if field, err := strconv.Atoi(v); err == nil && field > 0 {
+					rule.strip_fields = append(rule.strip_fields, field)
+				} else {
+					error_str += fmt.Sprintf("rule %s strip field %s must be a field number from 1;", rule.name, v)
+				}
+			}
+		case "add_fields":
+			rule.add_fields = values
+		default:
+			error_str += fmt.Sprintf("rule %s has unknown setting %s;", rule.name, parts[2])
+		}
+	}
+
+	rules := make([]*rewriteRule, 0, len(by_name))
+	for _, rule := range by_name {
+		if rule.match == "" {
+			error_str += fmt.Sprintf("rule %s has no match setting;", rule.name)
+		}
+		if rule.talker != "" && len(rule.talker) != 2 {
+			error_str += fmt.Sprintf("rule %s talker %s must be 2 characters;", rule.name, rule.talker)
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].name < rules[j].name })
+	return rules, error_str
+}
+
+func (n *NmeaMux) rewriteProcess(name string) error {
+	// rewrites sentences from the input channel using the first matching rule
+	// and sends them, or unmatched sentences unchanged, to the outputs
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	error_str := ""
+
+	input := ""
+	if inputs, found := config["input"]; found && len(inputs) == 1 {
+		input = inputs[0]
+	} else {
+		error_str += "Invalid number of input settings must be exactly 1;"
+	}
+
+	rules, rule_errors := parseRewriteRules(config)
+	error_str += rule_errors
+	if len(rules) == 0 {
+		error_str += "No rules defined;"
+	}
+
+	report := slices.Contains(config["report"], "on")
+
+	if len(error_str) > 0 {
+		log.Error(fmt.Sprintf("Rewrite <%s> Errors: %s", name, error_str))
+		return fmt.Errorf("rewrite %s has these errors:%s", name, error_str)
+	}
+
+	outputs := config["outputs"]
+	log.Info(fmt.Sprintf("Started rewrite %s on %s with %d rules", name, input, len(rules)))
+	n.goDevice(name, func(ctx context.Context) {
+		rewriter(ctx, name, rules, input, outputs, n.deviceStats(name), n.deviceLogger(name), n.deviceChannels(name), report)
+	})
+	return nil
+}
+
+func rewriter(ctx context.Context, name string, rules []*rewriteRule, input string, outputs []string,
+	stats *deviceStats, log *slog.Logger, channels *map[string](chan string), report bool) {
+	for {
+		var str string
+		select {
+		case str = <-(*channels)[input]:
+		case <-ctx.Done():
+			return
+		}
+		stats.received(str)
+		tag, sentence := trim_tag(str)
+		talker, sentence_type := sentenceAddress(sentence)
+		for _, rule := range rules {
+			if sentence_type != "" && rule.matches(talker, sentence_type) {
+				sentence = rule.apply(sentence)
+				if report {
+					log.Debug(fmt.Sprintf("Rewrite %s rule %s:  %s to %s", name, rule.name, str, sentence), "category", category_device)
+				}
+				if tag != "" {
+					str = fmt.Sprintf("@%s@%s", tag, sentence)
+				} else {
+					str = sentence
+				}
+				break
+			}
+		}
+		for _, out := range outputs {
+			if !stats.send(ctx, (*channels)[out], str) {
+				log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+			}
+		}
+	}
+}
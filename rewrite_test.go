@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestRewriteRuleApply(t *testing.T) {
+	rule := rewriteRule{
+		match:        "HDG",
+		talker:       "HC",
+		sentence:     "HDM",
+		strip_fields: []int{2, 3, 4, 5},
+		add_fields:   []string{"M"},
+	}
+	if !rule.matches("II", "HDG") || rule.matches("II", "HDT") {
+		t.Error("HDG rule matching wrong")
+	}
+	got := rule.apply("$IIHDG,200.5,0.0,E,1.5,W*7B")
+	if got != "$HCHDM,200.5,M*2E" {
+		t.Errorf("Rewrite HDG to HDM got %s", got)
+	}
+}
+
+func TestRewriteDevice(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Rewrite_config)
+	n.monitor_active = true
+	if err := n.RunDevice("instrument_rewrite", n.devices["instrument_rewrite"]); err != nil {
+		t.Errorf("Rewrite failed to start %s", err)
+	}
+	n.Channels["from_instruments"] <- "@ii_@$IIHDG,200.5,0.0,E,1.5,W*7B"
+	n.Channels["from_instruments"] <- "$YDDPT,5.2,0.5*5B"
+	n.Channels["from_instruments"] <- "$GPRMC,092750.000,A,5321.6802,N,00630.3372,W,0.02,31.66,280511,,,A*43"
+
+	received := test_helpers.GetMessages(n.Channels["to_autohelm"])
+	expected := []string{
+		"@ii_@$HCHDM,200.5,M*2E",
+		"$IIDPT,5.2,0.5*42",
+		"$GPRMC,092750.000,A,5321.6802,N,00630.3372,W,0.02,31.66,280511,,,A*43",
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d sentences got %s", len(expected), received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Expected %s got %s", expected[i], received[i])
+		}
+	}
+}
+
+func TestRewriteRuleEmptySetting(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfigFromMap(map[string]any{
+		"instrument_rewrite": map[string]any{
+			"type": "rewrite", "input": "to_rewrite", "outputs": []string{"to_processor"},
+			"rules": map[string]any{"x": map[string]any{"match": ""}},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "rule x match has no value") {
+		t.Errorf("Expected an error for the empty match got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Checksum settings for input devices
+const (
+	checksum_ignore  = "ignore"  // pass sentences unchanged
+	checksum_fix     = "fix"     // drop corrupt sentences and append a checksum if missing
+	checksum_require = "require" // drop corrupt sentences and those without a checksum
+)
+
+// Returns the 2 digit hex checksum of a sentence, the XOR of the characters
+// between the leading $ or ! and the * or end of the sentence
+func nmeaChecksum(str string) string {
+	check_sum := byte(0)
+	for i := 1; i < len(str) && str[i] != '*'; i++ {
+		check_sum ^= str[i]
+	}
+	return fmt.Sprintf("%02X", check_sum)
+}
+
+// Checks the form of an untagged sentence. has_checksum is set if it ends in *hh
+// and valid is false if it has bad characters, no $ or ! start or a wrong checksum
+func checkSentence(str string) (has_checksum bool, valid bool) {
+	l := len(str)
+	if l < 6 || (str[0] != '$' && str[0] != '!') {
+		return false, false
+	}
+	star := strings.LastIndexByte(str, '*')
+	for i := 1; i < l; i++ {
+		if str[i] < 0x20 || str[i] > 0x7e || str[i] == '$' || str[i] == '!' {
+			return star >= 0, false
+		}
+	}
+	if star < 0 {
+		return false, true
+	}
+	if star != l-3 {
+		return true, false
+	}
+	return true, strings.EqualFold(str[star+1:], nmeaChecksum(str))
+}
+
+// Returns the talker ID and sentence type of an untagged sentence eg GP and RMC
+// for $GPRMC,... Proprietary sentences have talker P eg P and GRMZ for $PGRMZ,...
+func sentenceAddress(str string) (talker string, sentence_type string) {
+	if len(str) < 2 || (str[0] != '$' && str[0] != '!') {
+		return "", ""
+	}
+	end := strings.IndexAny(str, ",*")
+	if end < 0 {
+		end = len(str)
+	}
+	address := str[1:end]
+	if len(address) > 1 && address[0] == 'P' {
+		return "P", address[1:]
+	}
+	if len(address) < 3 {
+		return "", address
+	}
+	return address[:2], address[2:]
+}
+
+// Applies a device's checksum setting to sentences before they reach any channel
+type checksumFilter struct {
+	mode   string
+	device string
+	report bool
+	log    *slog.Logger
+	errors atomic.Int64
+	fixed  atomic.Int64
+	stats  *deviceStats
+}
+
+// Makes the checksum filter for a device, drops are reported if the device report
+// list includes checksum and device reports are enabled on the monitor
+func (n *NmeaMux) newChecksumFilter(device string) *checksumFilter {
+	config := n.Config.Values[device]
+	report := slices.Contains(config["report"], "checksum")
+	c := newChecksumFilter(device, config, report, n.deviceLogger(device))
+	c.stats = n.deviceStats(device)
+	return c
+}
+
+func newChecksumFilter(device string, config map[string][]string, report bool, log *slog.Logger) *checksumFilter {
+	c := checksumFilter{
+		mode:   checksum_ignore,
+		device: device,
+		report: report,
+		log:    log,
+	}
+	if modes, found := config["checksum"]; found && len(modes) > 0 {
+		switch modes[0] {
+		case checksum_ignore, checksum_fix, checksum_require:
+			c.mode = modes[0]
+		default:
+			log.Warn(fmt.Sprintf("Device %s checksum setting <%s> must be require, fix or ignore - ignore used",
+				device, modes[0]))
+		}
+	}
+	return &c
+}
+
+// Returns the sentence to forward, with a checksum added if fixing, and false
+// if it must be dropped
+func (c *checksumFilter) filter(str string) (string, bool) {
+	if c.mode == checksum_ignore {
+		return str, true
+	}
+	str = strings.TrimSpace(str)
+	has_checksum, valid := checkSentence(str)
+	if valid && !has_checksum {
+		if c.mode == checksum_fix {
+			c.fixed.Add(1)
+			return fmt.Sprintf("%s*%s", str, nmeaChecksum(str)), true
+		}
+		valid = false
+	}
+	if !valid {
+		count := c.errors.Add(1)
+		c.stats.checksumError()
+		if c.report {
+			c.log.Debug(fmt.Sprintf("Device %s checksum error %d dropped: %q", c.device, count, str), "category", category_device)
+		}
+		return "", false
+	}
+	return str, true
+}
+
+// Returns the checksum error count
+func (c *checksumFilter) Errors() int64 {
+	return c.errors.Load()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestCheckSentence(t *testing.T) {
+	tests := []struct {
+		sentence     string
+		has_checksum bool
+		valid        bool
+	}{
+		{"$HCHDM,200.5,M*2E", true, true},
+		{"$HCHDM,200.5,M*2e", true, true},
+		{"!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26", true, true},
+		{"$HCHDM,200.5,M", false, true},
+		{"$HCHDM,200.5,M*2F", true, false},
+		{"$HCHDM,200.5,M*2", true, false},
+		{"$HCHD\x01M,200.5,M*2E", true, false},
+		{"$HCHD$GPRMC,200.5,M", false, false},
+		{"HCHDM,200.5,M*2E", false, false},
+		{"$HC", false, false},
+	}
+	for _, test := range tests {
+		has_checksum, valid := checkSentence(test.sentence)
+		if has_checksum != test.has_checksum || valid != test.valid {
+			t.Errorf("checkSentence(%q) got %t %t expected %t %t", test.sentence, has_checksum, valid,
+				test.has_checksum, test.valid)
+		}
+	}
+}
+
+func TestChecksumFilterModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		sentence string
+		expected string
+		ok       bool
+	}{
+		{"ignore", "$HCHDM,200.5,M*2F", "$HCHDM,200.5,M*2F", true},
+		{"require", "$HCHDM,200.5,M*2E", "$HCHDM,200.5,M*2E", true},
+		{"require", "$HCHDM,200.5,M", "", false},
+		{"require", "$HCHDM,200.5,M*2F", "", false},
+		{"fix", "$HCHDM,200.5,M", "$HCHDM,200.5,M*2E", true},
+		{"fix", "$HCHDM,200.5,M*2F", "", false},
+		{"fix", "$HCHDM,200.5,M*2E\r\n", "$HCHDM,200.5,M*2E", true},
+	}
+	for _, test := range tests {
+		c := newChecksumFilter("test", map[string][]string{"checksum": {test.mode}}, false, slog.Default())
+		str, ok := c.filter(test.sentence)
+		if str != test.expected || ok != test.ok {
+			t.Errorf("%s filter(%q) got %q %t expected %q %t", test.mode, test.sentence, str, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestSerialChecksumRequire(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Checksum_config)
+	n.monitor_log.configure(slog.LevelInfo, []string{"device"})
+	monitor := captureMonitor(n)
+	message := "$HCHDM,200.5,M*2E\r\n$HCHDM,200.5,M*2F\r\n$HCHDM,201.5,M\r\n"
+	n.SerialIoDevices["compass"] = &mockSerialDevice{readBuff: []byte(message)}
+	n.monitor_active = true
+	n.RunDevice("compass", n.devices["compass"])
+	time.Sleep(100 * time.Millisecond)
+
+	received := test_helpers.GetMessages(n.Channels["to_processor"])
+	if len(received) != 1 || received[0] != "@cp_@$HCHDM,200.5,M*2E" {
+		t.Errorf("Expected only the valid sentence got %s", received)
+	}
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Device compass checksum error 1 dropped: \"$HCHDM,200.5,M*2F\"",
+		"Device compass checksum error 2 dropped: \"$HCHDM,201.5,M\"",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
+
+func TestSerialChecksumFix(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Checksum_config)
+	message := "$HCHDM,200.5,M\r\n$HCHDM,200.5,M*2F\r\n"
+	n.SerialIoDevices["gps"] = &mockSerialDevice{readBuff: []byte(message)}
+	n.monitor_active = true
+	n.RunDevice("gps", n.devices["gps"])
+	time.Sleep(100 * time.Millisecond)
+
+	received := test_helpers.GetMessages(n.Channels["to_processor"])
+	if len(received) != 1 || received[0] != "$HCHDM,200.5,M*2E" {
+		t.Errorf("Expected checksum to be added got %s", received)
+	}
+}
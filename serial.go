@@ -6,123 +6,287 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package nmea_mux
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"github.com/martinmarsh/nmea-mux/io"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"slices"
 )
 
+type serialSettings struct {
+	port         io.SerialPortSelector
+	outputs      []string
+	input        string
+	tag          string
+	checksum     *checksumFilter
+	stats        *deviceStats
+	report_tx    bool
+	report_rx    bool
+	read_timeout time.Duration
+	max_backoff  time.Duration
+	baud         serialBaud
+}
+
 func (n *NmeaMux) serialProcess(name string) error {
+	log := n.deviceLogger(name)
 
-	(n.Monitor_channel) <- fmt.Sprintf("started navmux serial %s", name)
+	log.Info(fmt.Sprintf("started navmux serial %s", name))
 	config := n.Config.Values[name]
 
-	var baud int64 = 4800
 	var err error = nil
-	var report_tx = false
-	var report_rx = false
+	settings := serialSettings{
+		outputs:     config["outputs"],
+		max_backoff: 30 * time.Second,
+	}
 
-	tag := ""
 	if origin_tags, found := config["origin_tag"]; found {
 		if len(origin_tags) > 0 {
-			tag = fmt.Sprintf("@%s@", origin_tags[0])
+			settings.tag = fmt.Sprintf("@%s@", origin_tags[0])
 		}
 	}
 
-	if baud_list, found := config["baud"]; found {
-		if len(baud_list) > 0 {
-			if baud, err = strconv.ParseInt(baud_list[0], 10, 32); err != nil {
-				baud = 4800
-			}
-		}
+	var error_str string
+	if settings.baud, error_str = parseSerialBaud(config); error_str != "" {
+		log.Error(fmt.Sprintf("Serial device %s has invalid baud settings: %s", name, error_str))
+		return fmt.Errorf("serial %s has invalid baud settings: %s", name, error_str)
 	}
 
-	
-	portName := config["name"][0]
+	if settings.port, error_str = parseSerialPort(config); error_str != "" {
+		log.Error(fmt.Sprintf("Serial device %s %s", name, strings.TrimSuffix(error_str, ";")))
+		return fmt.Errorf("serial %s has no port name", name)
+	}
 
-	if slices.Contains(n.monitor_report, "device"){
-		if reports, found := config["report"]; found {
-			for _, v := range(reports){
-				switch v{
-				case "tx":
-					report_tx = true
-				case "rx":
-					report_rx = true
-				}
-			}
+	if inputs, found := config["input"]; found && len(inputs) == 1 {
+		settings.input = inputs[0]
+	}
+
+	if max_backoffs, found := config["max_backoff"]; found {
+		seconds := 0
+		if len(max_backoffs) == 1 {
+			seconds, _ = strconv.Atoi(max_backoffs[0])
+		}
+		if seconds > 0 {
+			settings.max_backoff = time.Duration(seconds) * time.Second
+		} else {
+			log.Error(fmt.Sprintf("Serial device %s max_backoff must be a number of seconds greater than 0", name))
+			return fmt.Errorf("serial %s has an invalid max_backoff", name)
 		}
 	}
-	
 
-	n.SerialIoDevices[name].SetMode(int(baud), portName)
+	if reports, found := config["report"]; found {
+		for _, v := range(reports){
+			switch v{
+			case "tx":
+				settings.report_tx = true
+			case "rx":
+				settings.report_rx = true
+			}
+		}
+	}
 
-	(n.Monitor_channel) <- fmt.Sprintf("Serial device %s baud rate set to %d", name, baud)
+	options, error_str := parseSerialOptions(config)
+	if error_str != "" {
+		log.Error(fmt.Sprintf("Serial device %s has invalid line settings: %s", name, error_str))
+		return fmt.Errorf("serial %s has invalid line settings: %s", name, error_str)
+	}
+	if settings.baud.auto && options.ReadTimeout == 0 {
+		options.ReadTimeout = auto_read_timeout
+	}
+	if err = n.SerialIoDevices[name].SetOptions(options); err != nil {
+		log.Error(fmt.Sprintf("Serial device %s line settings error: %s", name, err))
+		return fmt.Errorf("serial %s line settings error: %w", name, err)
+	}
+	settings.read_timeout = options.ReadTimeout
 
-	err = n.SerialIoDevices[name].Open()
+	n.SerialIoDevices[name].SetPortSelector(settings.port)
+	n.SerialIoDevices[name].SetMode(settings.baud.baud, settings.port.Name)
 
-	if err != nil {
-		(n.Monitor_channel) <- fmt.Sprintf("Serial device %s <name> == <%s> should be a valid port error: %s",
-			name, portName, err)
+	if settings.baud.auto {
+		log.Info(fmt.Sprintf("Serial device %s baud rate auto from %v", name, settings.baud.bauds))
 	} else {
-		if outputs, found := config["outputs"]; found {
-			if len(outputs) > 0 {
-				(n.Monitor_channel) <- fmt.Sprintf("Open read serial port " + portName)
-				go serialReader(name, n.SerialIoDevices[name], outputs, tag, &n.Monitor_channel, &n.Channels, report_rx)
+		log.Info(fmt.Sprintf("Serial device %s baud rate set to %d", name, settings.baud.baud))
+	}
+	if options.FlowControl == "rts_cts" {
+		log.Info(fmt.Sprintf("Serial device %s line set to %s writes wait for CTS", name, lineName(options)))
+	} else {
+		log.Info(fmt.Sprintf("Serial device %s line set to %s", name, lineName(options)))
+	}
+
+	ser := n.SerialIoDevices[name]
+	settings.checksum = n.newChecksumFilter(name)
+	settings.stats = n.deviceStats(name)
+	n.onStop(name, func() { ser.Close() })
+	n.goDevice(name, func(ctx context.Context) {
+		serialConnection(ctx, name, ser, settings, n.deviceLogger(name), n.deviceChannels(name))
+	})
+
+	return nil
+
+}
+
+// Keeps the port open, retrying with a doubling backoff up to max_backoff
+// while it cannot be opened eg a USB adapter is unplugged, and reopening
+// it after a read or write error. With baud: auto the rate is detected
+// each time the port is opened and again when the sentences degrade.
+func serialConnection(ctx context.Context, name string, ser io.Serial_interfacer, settings serialSettings,
+	log *slog.Logger, channels *map[string](chan string)) {
+	backoff := time.Second
+	opened := false
+	lost := false
+	for {
+		if err := ser.Open(); err != nil {
+			log.Warn(fmt.Sprintf("Serial device %s <name> == <%s> should be a valid port error: %s - retry in %s",
+				name, settings.port, err, backoff))
+			if !sleepContext(ctx, backoff) {
+				return
 			}
+			backoff = min(backoff*2, settings.max_backoff)
+			continue
 		}
-		if inputs, found := config["input"]; found {
-			if len(inputs) == 1 {
-				(n.Monitor_channel) <- fmt.Sprintf("Open write serial port " + portName)
-				go serialWriter(name, n.SerialIoDevices[name], inputs[0], &n.Monitor_channel, &n.Channels, report_tx)
+		if settings.baud.auto {
+			if _, found := detectBaud(ctx, name, ser, settings, log); !found {
+				ser.Close()
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warn(fmt.Sprintf("Serial device %s baud rate not detected from %v - retry in %s",
+					name, settings.baud.bauds, backoff))
+				if !sleepContext(ctx, backoff) {
+					return
+				}
+				backoff = min(backoff*2, settings.max_backoff)
+				continue
 			}
 		}
-	}
+		backoff = time.Second
+		if opened && lost {
+			settings.stats.reconnected()
+		}
+		opened = true
+		connected_at := time.Now()
+		port_name := ser.PortName()
+		log.Info(fmt.Sprintf("Serial device %s connected to %s", name, port_name))
 
-	return nil
+		degraded := serialSession(ctx, name, ser, settings, log, channels)
+		if ctx.Err() != nil {
+			return
+		}
+		if lost = !degraded; degraded {
+			log.Warn(fmt.Sprintf("Serial device %s sentences from %s are mostly invalid - detecting baud rate again",
+				name, port_name))
+			continue
+		}
+		log.Warn(fmt.Sprintf("Serial device %s disconnected from %s after %s", name, port_name,
+			time.Since(connected_at).Round(time.Second)))
+		// give a replugged adapter time to appear again
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+	}
+}
 
+// Runs the reader and writer on the open port until either fails or ctx
+// is done, then closes the port. Returns true if the reader stopped
+// because the sentences degraded.
+func serialSession(ctx context.Context, name string, ser io.Serial_interfacer, settings serialSettings,
+	log *slog.Logger, channels *map[string](chan string)) bool {
+	degraded := false
+	session_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	if len(settings.outputs) > 0 {
+		log.Info(fmt.Sprintf("Open read serial port " + ser.PortName()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			degraded = serialReader(session_ctx, name, ser, settings, log, channels)
+		}()
+	}
+	if settings.input != "" {
+		log.Info(fmt.Sprintf("Open write serial port " + ser.PortName()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			serialWriter(session_ctx, name, ser, settings, log, channels)
+		}()
+	}
+	<-session_ctx.Done()
+	ser.Close()
+	wg.Wait()
+	return degraded
 }
 
-func serialReader(name string, ser io.Serial_interfacer, outputs []string, tag string, monitor_channel *chan string,
-	channels *map[string](chan string), report_rx bool) {
+// Reads sentences from the port to the outputs until a read error or ctx
+// is done. With baud: auto returns true if most sentences become invalid.
+func serialReader(ctx context.Context, name string, ser io.Serial_interfacer, settings serialSettings,
+	log *slog.Logger, channels *map[string](chan string)) bool {
+	stats := settings.stats
+	monitor := baudMonitor{}
 	buff := make([]byte, 25)
-	cb := MakeByteBuffer(400, 92)
-	time.Sleep(100 * time.Millisecond)
+	framer := newLineFramer(max_line_len)
+	if !sleepContext(ctx, 100*time.Millisecond) {
+		return false
+	}
 	for {
 		n, err := ser.Read(&buff)
 
+		if ctx.Err() != nil {
+			// port closed on shutdown or by the writer failing
+			return false
+		}
 		if err != nil {
-			*(monitor_channel) <- fmt.Sprintf("FATAL Error on port %s", name)
-			time.Sleep(5 * time.Second)
+			log.Error(fmt.Sprintf("Serial read error on port %s error: %s - reopening", name, err))
+			return false
+		}
+		if n == 0 && settings.read_timeout > 0 {
+			// nothing arrived within the read timeout
+			continue
 		}
 		if n == 0 {
-			*(monitor_channel) <- fmt.Sprintf("EOF on read of %s", name)
-			time.Sleep(5 * time.Second)
-		} else {
-			for i := 0; i < n; i++ {
-				if buff[i] != 10 {
-					cb.Write_byte(buff[i])
-				}
+			log.Warn(fmt.Sprintf("EOF on read of %s", name))
+			if !sleepContext(ctx, 5*time.Second) {
+				return false
 			}
+		} else {
+			framer.write(buff[:n])
 		}
 		for {
-			str, err := cb.ReadString()
+			line, err := framer.next()
 			if err != nil {
-				*(monitor_channel) <- fmt.Sprintf("Serial read error in %s error %s", name, err)
+				log.Error(fmt.Sprintf("Serial read error in %s error %s", name, err))
+				stats.parseError()
+				// discarded bytes count as invalid sentences at the wrong rate
+				if settings.baud.auto && monitor.degraded("") {
+					return true
+				}
+				continue
 			}
-
-			if len(str) == 0 {
+			if line == nil {
 				break
 			}
-			str = tag + str
-			if report_rx {
-				*(monitor_channel) <- fmt.Sprintf("Serial  %s Rx:  %s", name, str)
+			str := string(line)
+			stats.received(str)
+			if settings.baud.auto && monitor.degraded(str) {
+				return true
+			}
+			var ok bool
+			if str, ok = settings.checksum.filter(str); !ok {
+				continue
 			}
-			for _, out := range outputs {
-				select {
-    				case (*channels)[out] <- str:
-    				default:
-						fmt.Println("In serial", name, "message '", str, "'could not be put on", out, "channel - may be full")
+			str = settings.tag + str
+			if settings.report_rx {
+				log.Debug(fmt.Sprintf("Serial  %s Rx:  %s", name, str), "category", category_device)
+			}
+			for _, out := range settings.outputs {
+				if !stats.send(ctx, (*channels)[out], str) {
+					log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
 				}
 			}
 
@@ -130,20 +294,129 @@ func serialReader(name string, ser io.Serial_interfacer, outputs []string, tag s
 	}
 }
 
-func serialWriter(name string, ser io.Serial_interfacer, input string, monitor_channel *chan string,
-	channels *map[string](chan string), report_tx bool) {
-	time.Sleep(100 * time.Millisecond)
+// Writes sentences from the input to the port until a write error or ctx is done
+func serialWriter(ctx context.Context, name string, ser io.Serial_interfacer, settings serialSettings,
+	log *slog.Logger, channels *map[string](chan string)) {
+	stats := settings.stats
+	if !sleepContext(ctx, 100*time.Millisecond) {
+		return
+	}
 	for {
-		str := <-(*channels)[input]
+		var str string
+		select {
+		case str = <-(*channels)[settings.input]:
+		case <-ctx.Done():
+			return
+		}
+		stats.received(str)
 		_, str = trim_tag(str)
 		str += "\r\n"
-		if report_tx {
-			*(monitor_channel) <- fmt.Sprintf("Serial  %s Tx:  %s", name, str)
+		if settings.report_tx {
+			log.Debug(fmt.Sprintf("Serial  %s Tx:  %s", name, str), "category", category_device)
 		}
 		_, err := ser.Write([]byte(str))
+		if errors.Is(err, io.ErrCTSNotSet) {
+			// the port is still open so only this sentence is lost
+			log.Warn(fmt.Sprintf("Serial %s sentence dropped: %s", name, err), "sentence", str)
+			continue
+		}
 		if err != nil {
-			*(monitor_channel) <- fmt.Sprintf("Serial write error in %s error %s", name, err)
-			time.Sleep(time.Minute)
+			log.Error(fmt.Sprintf("Serial write error in %s error %s - reopening", name, err))
+			return
+		}
+		stats.sent(str)
+	}
+}
+
+// Parses the port name, which may be a glob, and the USB details used to
+// choose the port returning an error if there are none
+func parseSerialPort(config map[string][]string) (io.SerialPortSelector, string) {
+	selector := io.SerialPortSelector{}
+	if names, found := config["name"]; found && len(names) == 1 {
+		selector.Name = names[0]
+	}
+	if vids, found := config["usb_vid"]; found && len(vids) == 1 {
+		selector.VID = io.NormaliseUsbId(vids[0])
+	}
+	if pids, found := config["usb_pid"]; found && len(pids) == 1 {
+		selector.PID = io.NormaliseUsbId(pids[0])
+	}
+	if serials, found := config["usb_serial"]; found && len(serials) == 1 {
+		selector.SerialNumber = serials[0]
+	}
+	if selector == (io.SerialPortSelector{}) {
+		return selector, "must have exactly 1 port name or a usb_vid, usb_pid or usb_serial setting;"
+	}
+	error_str := ""
+	for _, key := range []string{"usb_vid", "usb_pid"} {
+		id := io.NormaliseUsbId(strings.Join(config[key], ""))
+		if _, err := strconv.ParseUint(id, 16, 16); id != "" && (err != nil || len(id) != 4) {
+			error_str += fmt.Sprintf("%s %s must be 4 hex digits eg 0403;", key, config[key][0])
+		}
+	}
+	return selector, error_str
+}
+
+// Parses the line settings of a serial device returning the options and
+// any errors separated by ";"
+func parseSerialOptions(config map[string][]string) (io.SerialOptions, string) {
+	options := io.DefaultSerialOptions()
+	error_str := ""
+	if data_bits, found := config["data_bits"]; found && len(data_bits) > 0 {
+		if bits, err := strconv.Atoi(data_bits[0]); err == nil && bits >= 5 && bits <= 8 {
+			options.DataBits = bits
+		} else {
+			error_str += fmt.Sprintf("data_bits %s must be 5, 6, 7 or 8;", data_bits[0])
+		}
+	}
+	if parities, found := config["parity"]; found && len(parities) > 0 {
+		if slices.Contains([]string{"none", "odd", "even", "mark", "space"}, parities[0]) {
+			options.Parity = parities[0]
+		} else {
+			error_str += fmt.Sprintf("parity %s must be none, odd, even, mark or space;", parities[0])
+		}
+	}
+	if stop_bits, found := config["stop_bits"]; found && len(stop_bits) > 0 {
+		if slices.Contains([]string{"1", "1.5", "2"}, stop_bits[0]) {
+			options.StopBits = stop_bits[0]
+		} else {
+			error_str += fmt.Sprintf("stop_bits %s must be 1, 1.5 or 2;", stop_bits[0])
+		}
+	}
+	if flow_controls, found := config["flow_control"]; found && len(flow_controls) > 0 {
+		if slices.Contains([]string{"none", "rts_cts"}, flow_controls[0]) {
+			options.FlowControl = flow_controls[0]
+		} else {
+			error_str += fmt.Sprintf("flow_control %s must be none or rts_cts;", flow_controls[0])
 		}
 	}
+	if read_timeouts, found := config["read_timeout"]; found && len(read_timeouts) > 0 {
+		if timeout, err := strconv.Atoi(read_timeouts[0]); err == nil && timeout >= 0 {
+			options.ReadTimeout = time.Duration(timeout) * time.Millisecond
+		} else {
+			error_str += fmt.Sprintf("read_timeout %s must be a number of ms;", read_timeouts[0])
+		}
+	}
+	if dtrs, found := config["dtr"]; found && len(dtrs) > 0 {
+		options.DTR = dtrs[0] == "on"
+	}
+	if rtss, found := config["rts"]; found && len(rtss) > 0 {
+		options.RTS = rtss[0] == "on"
+	}
+
+	if options.StopBits == "1.5" && options.DataBits != 5 {
+		error_str += "stop_bits 1.5 can only be used with data_bits 5;"
+	}
+	if options.StopBits == "2" && options.DataBits == 5 {
+		error_str += "stop_bits 2 cannot be used with data_bits 5, use 1.5;"
+	}
+	if options.FlowControl == "rts_cts" && !options.RTS {
+		error_str += "flow_control rts_cts needs rts on;"
+	}
+	return options, error_str
+}
+
+// Returns the usual short name of the line settings eg 8N1 or 7E1
+func lineName(options io.SerialOptions) string {
+	return fmt.Sprintf("%d%s%s", options.DataBits, strings.ToUpper(options.Parity[:1]), options.StopBits)
 }
@@ -1,40 +1,82 @@
 package nmea_mux
 
 import (
+	"context"
 	"errors"
-	//"fmt"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/martinmarsh/nmea-mux/io"
 	"github.com/martinmarsh/nmea-mux/test_data"
 	"github.com/martinmarsh/nmea-mux/test_helpers"
 )
 
 type mockSerialDevice struct {
-	baud        int
-	portName    string
-	openError   error
-	readBuff    []byte
-	readPointer int
-	readError   error
-	writeBuff   []byte
-	writeError  error
-	writeSent   string
+	baud         int
+	portName     string
+	openError    error
+	readBuff     []byte
+	readPointer  int
+	readError    error
+	writeBuff    []byte
+	writeError   error
+	writeSent    string
+	closed       bool
+	close_mu     sync.Mutex
+	selector     io.SerialPortSelector
+	options      io.SerialOptions
+	opens        int
+	openFailures int            // opens which fail as if the adapter is unplugged
+	readFailures int            // reads which fail as if the adapter is unplugged
+	baudData     map[int]string // what is read at each baud rate in place of readBuff
 }
 
 func (s *mockSerialDevice) SetMode(baud int, port string) error {
 	s.baud = baud
 	s.portName = port
+	if s.baudData != nil {
+		s.readBuff = []byte(s.baudData[baud])
+		s.readPointer = 0
+	}
+	return nil
+}
+
+func (s *mockSerialDevice) SetOptions(options io.SerialOptions) error {
+	s.options = options
+	return nil
+}
+
+func (s *mockSerialDevice) SetPortSelector(selector io.SerialPortSelector) error {
+	s.selector = selector
 	return nil
 }
 
+func (s *mockSerialDevice) PortName() string {
+	if s.portName == "" {
+		return s.selector.String()
+	}
+	return s.portName
+}
+
 func (s *mockSerialDevice) Open() error {
+	s.opens++
+	if s.openFailures > 0 {
+		s.openFailures--
+		return errors.New("mock port not found")
+	}
 	s.readPointer = 0
 	s.writeSent = ""
 	return s.openError
 }
 
 func (s *mockSerialDevice) Read(buff *[]byte) (int, error) {
+	if s.readFailures > 0 {
+		s.readFailures--
+		return 0, errors.New("mock port disconnected")
+	}
 	l_buff := len(s.readBuff)
 	n := 0
 	if s.readError == nil && s.readPointer < l_buff {
@@ -43,6 +85,10 @@ func (s *mockSerialDevice) Read(buff *[]byte) (int, error) {
 		//s.readBuff[n+2] = 0
 		s.readPointer += n
 	}
+	if n == 0 && s.baudData != nil {
+		// as if the read timed out
+		time.Sleep(time.Millisecond)
+	}
 	return n, s.readError
 }
 
@@ -55,15 +101,24 @@ func (s *mockSerialDevice) Write(buff []byte) (int, error) {
 	return n, s.writeError
 }
 
+func (s *mockSerialDevice) Close() error {
+	// closed by the device on errors and by the mux on shutdown
+	s.close_mu.Lock()
+	defer s.close_mu.Unlock()
+	s.closed = true
+	return nil
+}
+
 func TestRunSerialFail(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	n.SerialIoDevices["compass"] = &mockSerialDevice{
 		openError: errors.New("mock test open failed"),
 	}
 	n.monitor_active = true
 	n.RunDevice("compass", n.devices["compass"])
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"started navmux serial compass",
 		"Serial device compass baud rate set to 4800",
@@ -80,6 +135,7 @@ func TestRunSerialFail(t *testing.T) {
 func TestRunSerialEOF(t *testing.T) {
 	// Normally serial read will wait and never return 0 bytes unless end of file
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	n.SerialIoDevices["compass"] = &mockSerialDevice{
 		openError: nil,
@@ -90,7 +146,7 @@ func TestRunSerialEOF(t *testing.T) {
 	n.monitor_active = true
 	n.RunDevice("compass", n.devices["compass"])
 	time.Sleep(500 * time.Millisecond)
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"started navmux serial compass",
 		"Serial device compass baud rate set to 4800",
@@ -106,10 +162,11 @@ func TestRunSerialEOF(t *testing.T) {
 func TestRunSerialReadMessage(t *testing.T) {
 	// Normally serial read will wait and never return 0 bytes unless end of file
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
-	message := "Message 1\r\nMessage 2\r\nMessage 3\r\nMessage 4\r\n"
-	message += "Message 5 very long message 1234567890 123457890 1234567890 1234567890 1234567890 01234567890 01234567890 01234567890 abcdef\r\n"
-	message += "Message 6\r\nMessage 7\r\nMessage 8\r\npart message"
+	message := "$GPMSG,1\r\n$GPMSG,2\r\n$GPMSG,3\r\n$GPMSG,4\r\n"
+	message += "$GPMSG,5 very long message 1234567890 123457890 1234567890 1234567890 1234567890 01234567890 01234567890 01234567890 abcdef\r\n"
+	message += "$GPMSG,6\r\n$GPMSG,7\r\n$GPMSG,8\r\n$GPMSG,part"
 	m := &mockSerialDevice{
 		openError: nil,
 		readError: nil,
@@ -121,11 +178,12 @@ func TestRunSerialReadMessage(t *testing.T) {
 	n.RunDevice("compass", n.devices["compass"])
 	time.Sleep(100 * time.Millisecond)
 
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"started navmux serial compass",
 		"Serial device compass baud rate set to 4800",
 		"Open read serial port /dev/ttyUSB0",
+		"Serial read error in compass error line too long - discarded",
 	}
 
 	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
@@ -134,28 +192,31 @@ func TestRunSerialReadMessage(t *testing.T) {
 
 	to_processor_messages := test_helpers.GetMessages(n.Channels["to_processor"])
 
+	// the long message 5 is discarded rather than split into 2 corrupt sentences
 	expected_messages = []string{
-		"@cp_@Message 1",
-		"@cp_@Message 2",
-		"@cp_@Message 3",
-		"@cp_@Message 4",
-		"@cp_@Message 5 very long message 1234567890 123457890 1234567890 1234567890 1234567890 0123456789",
-		"@cp_@0 01234567890 01234567890 abcdef",
-		"@cp_@Message 6",
-		"@cp_@Message 7",
-		"@cp_@Message 8",
+		"@cp_@$GPMSG,1",
+		"@cp_@$GPMSG,2",
+		"@cp_@$GPMSG,3",
+		"@cp_@$GPMSG,4",
+		"@cp_@$GPMSG,6",
+		"@cp_@$GPMSG,7",
+		"@cp_@$GPMSG,8",
 	}
 	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, to_processor_messages); not_found {
 		t.Errorf("To processor channel error %s", err.Error())
 	}
+	if len(to_processor_messages) != len(expected_messages) {
+		t.Errorf("Expected only %d messages got %q", len(expected_messages), to_processor_messages)
+	}
 
 }
 
 func TestRunSerialReadWriteMessages(t *testing.T) {
 	// Normally serial read will wait and never return 0 bytes unless end of file
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
-	message := "Message 1\r\nMessage 2\r\nMessage 3\r\nMessage 4\r\n"
+	message := "$GPMSG,1\r\n$GPMSG,2\r\n$GPMSG,3\r\n$GPMSG,4\r\n"
 	m := &mockSerialDevice{
 		openError:  nil,
 		readError:  nil,
@@ -168,7 +229,7 @@ func TestRunSerialReadWriteMessages(t *testing.T) {
 	n.RunDevice("bridge", n.devices["bridge"])
 	time.Sleep(100 * time.Millisecond)
 
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"started navmux serial bridge",
 		"Serial device bridge baud rate set to 38400",
@@ -184,10 +245,10 @@ func TestRunSerialReadWriteMessages(t *testing.T) {
 	to_processor_messages := test_helpers.GetMessages(n.Channels["to_processor"])
 
 	expected_messages = []string{
-		"@ray_@Message 1",
-		"@ray_@Message 2",
-		"@ray_@Message 3",
-		"@ray_@Message 4",
+		"@ray_@$GPMSG,1",
+		"@ray_@$GPMSG,2",
+		"@ray_@$GPMSG,3",
+		"@ray_@$GPMSG,4",
 	}
 	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, to_processor_messages); not_found {
 		t.Errorf("To processor channel error %s", err.Error())
@@ -202,3 +263,330 @@ func TestRunSerialReadWriteMessages(t *testing.T) {
 	}
 
 }
+
+func TestRunSerialShutdown(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	m := &mockSerialDevice{
+		readBuff:  []byte("$GPMSG,1\r\n"),
+		writeBuff: []byte(""),
+	}
+	n.SerialIoDevices["bridge"] = m
+	n.monitor_active = true
+	n.RunDevice("bridge", n.devices["bridge"])
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+	if !m.closed {
+		t.Error("Serial port was not closed on shutdown")
+	}
+}
+
+func TestRunSerialNoPortName(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Schema_config)
+	n.SerialIoDevices["compass"] = &mockSerialDevice{}
+	n.monitor_active = true
+	if err := n.RunDevice("compass", n.devices["compass"]); err == nil {
+		t.Error("Serial without a port name must fail to start")
+	}
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Serial device compass must have exactly 1 port name"}, messages); not_found {
+		t.Errorf("Expected port name error got %v", messages)
+	}
+}
+
+func TestRunSerialEmptyMaxBackoff(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	n.Config.Values["compass"]["max_backoff"] = []string{}
+	n.SerialIoDevices["compass"] = &mockSerialDevice{}
+	n.monitor_active = true
+	if err := n.RunDevice("compass", n.devices["compass"]); err == nil {
+		t.Error("Serial with an empty max_backoff must fail to start")
+	}
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Serial device compass max_backoff must be a number of seconds greater than 0"}, messages); not_found {
+		t.Errorf("Expected max_backoff error got %v", messages)
+	}
+}
+
+func TestSerialLineSettings(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Serial_line_config); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	ser := &mockSerialDevice{}
+	n.SerialIoDevices["seatalk_bridge"] = ser
+	n.monitor_active = true
+	n.RunDevice("seatalk_bridge", n.devices["seatalk_bridge"])
+	// the mock returns no data without waiting for the read timeout
+	defer n.Shutdown(context.Background())
+	messages := test_helpers.GetMessages(monitor)
+
+	expected := io.SerialOptions{DataBits: 7, Parity: "even", StopBits: "1", FlowControl: "rts_cts",
+		ReadTimeout: 200 * time.Millisecond, DTR: false, RTS: true}
+	if ser.options != expected {
+		t.Errorf("Expected options %+v got %+v", expected, ser.options)
+	}
+	expected_messages := []string{"Serial device seatalk_bridge line set to 7E1 writes wait for CTS"}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
+
+func TestSerialLineSettingErrors(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Bad_serial_line_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	expected := []string{
+		"seatalk_bridge: data_bits 9 must be 5, 6, 7 or 8",
+		"seatalk_bridge: flow_control rts_cts needs rts on",
+		"seatalk_bridge: parity evens must be none, odd, even, mark or space",
+		"seatalk_bridge: stop_bits 1.5 can only be used with data_bits 5",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Config. Expected %d errors got %s", len(expected), err)
+	}
+	for i := range expected {
+		if errs[i].Error() != expected[i] {
+			t.Errorf("Config. Expected %s got %s", expected[i], errs[i])
+		}
+	}
+}
+
+func TestSerialOpenRetry(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	m := &mockSerialDevice{openFailures: 1, readBuff: []byte("$GPMSG,1\r\n")}
+	n.SerialIoDevices["compass"] = m
+	n.monitor_active = true
+	n.RunDevice("compass", n.devices["compass"])
+	time.Sleep(1200 * time.Millisecond)
+
+	received := test_helpers.GetMessages(n.Channels["to_processor"])
+	if len(received) != 1 || received[0] != "@cp_@$GPMSG,1" {
+		t.Errorf("Expected the message once the port opened got %s", received)
+	}
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Serial device compass <name> == </dev/ttyUSB0> should be a valid port error: mock port not found - retry in 1s",
+		"Serial device compass connected to /dev/ttyUSB0",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	n.Shutdown(context.Background())
+	if m.opens != 2 || n.Stats().Devices["compass"].Reconnects != 0 {
+		t.Errorf("Expected 2 opens and no reconnects got %d %+v", m.opens, n.Stats().Devices["compass"])
+	}
+}
+
+func TestSerialReopenAfterReadError(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	m := &mockSerialDevice{readFailures: 1, readBuff: []byte("$GPMSG,1\r\n")}
+	n.SerialIoDevices["bridge"] = m
+	n.monitor_active = true
+	n.RunDevice("bridge", n.devices["bridge"])
+	time.Sleep(1300 * time.Millisecond)
+
+	received := test_helpers.GetMessages(n.Channels["to_processor"])
+	if len(received) != 1 || received[0] != "@ray_@$GPMSG,1" {
+		t.Errorf("Expected the message after reopening got %s", received)
+	}
+	send := "Writing after the port was reopened"
+	n.Channels["to_2000"] <- send
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Serial device bridge connected to /dev/ttyUSB1",
+		"Serial read error on port bridge error: mock port disconnected - reopening",
+		"Serial device bridge disconnected from /dev/ttyUSB1 after 0s",
+		"Serial device bridge connected to /dev/ttyUSB1",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	n.Shutdown(context.Background())
+	if m.writeSent != send+"\r\n" {
+		t.Errorf("Should have sent <%s> but got <%s>", send, m.writeSent)
+	}
+	if m.opens != 2 || n.Stats().Devices["bridge"].Reconnects != 1 {
+		t.Errorf("Expected 2 opens and 1 reconnect got %d %+v", m.opens, n.Stats().Devices["bridge"])
+	}
+}
+
+func TestSerialCTSTimeoutKeepsPortOpen(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	m := &mockSerialDevice{writeError: fmt.Errorf("%w by mock within 1s", io.ErrCTSNotSet)}
+	n.SerialIoDevices["bridge"] = m
+	n.monitor_active = true
+	n.RunDevice("bridge", n.devices["bridge"])
+	time.Sleep(200 * time.Millisecond)
+	n.Channels["to_2000"] <- "$ECAPB,A,A,0.10,R,N"
+	messages := test_helpers.GetMessages(monitor)
+	n.Shutdown(context.Background())
+
+	expected_messages := []string{
+		"Serial bridge sentence dropped: CTS not set by mock within 1s",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	if m.opens != 1 {
+		t.Errorf("Expected the port to stay open after a CTS timeout got %d opens", m.opens)
+	}
+}
+
+func TestSerialUsbPortSelection(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Usb_serial_config); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	gps := &mockSerialDevice{openFailures: 1}
+	ais := &mockSerialDevice{}
+	n.SerialIoDevices["gps"] = gps
+	n.SerialIoDevices["ais"] = ais
+	n.monitor_active = true
+	n.RunDevice("gps", n.devices["gps"])
+	n.RunDevice("ais", n.devices["ais"])
+	messages := test_helpers.GetMessages(monitor)
+	n.Shutdown(context.Background())
+
+	expected := io.SerialPortSelector{VID: "0403", PID: "6001", SerialNumber: "A9XK2L1"}
+	if gps.selector != expected {
+		t.Errorf("Expected gps selector %+v got %+v", expected, gps.selector)
+	}
+	if ais.selector.Name != "/dev/serial/by-id/usb-Digital_Yacht*" {
+		t.Errorf("Expected ais selected by glob got %+v", ais.selector)
+	}
+	expected_messages := []string{
+		"Serial device gps <name> == <usb_vid 0403 usb_pid 6001 usb_serial A9XK2L1> should be a valid port error: mock port not found",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
+
+func TestSerialUsbPortErrors(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Bad_usb_serial_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	if len(errs) != 1 || errs[0].Error() != "gps: usb_vid 04x3 must be 4 hex digits eg 0403" {
+		t.Errorf("Expected usb_vid error got %s", err)
+	}
+}
+
+// Repeats a sentence with its checksum as an instrument would send it
+func baudSentences(sentence string, count int) string {
+	str := ""
+	for i := 0; i < count; i++ {
+		str += sentence + "*" + nmeaChecksum(sentence) + "\r\n"
+	}
+	return str
+}
+
+func TestSerialBaudAuto(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Baud_auto_config); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	m := &mockSerialDevice{baudData: map[int]string{
+		4800:  "\x92\xf3$\x0b\xe1\r\n\xfe~\x13\r\n\x80\x80\xf8\r\n",
+		38400: baudSentences("$HCHDM,172.5,M", 10),
+	}}
+	n.SerialIoDevices["compass"] = m
+	n.monitor_active = true
+	n.RunDevice("compass", n.devices["compass"])
+	messages := test_helpers.GetMessages(monitor)
+	n.Shutdown(context.Background())
+
+	if m.options.ReadTimeout != auto_read_timeout {
+		t.Errorf("Expected read timeout %s for baud detection got %s", auto_read_timeout, m.options.ReadTimeout)
+	}
+	if m.baud != 38400 {
+		t.Errorf("Expected baud rate 38400 to be detected got %d", m.baud)
+	}
+	expected := []string{
+		"Serial device compass baud rate auto from [4800 38400 115200]",
+		"Serial device compass baud rate detected as 38400 from 10 valid sentences",
+		"Serial device compass connected to /dev/ttyUSB0",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	if got := len(n.Channels["to_processor"]); got != 10 {
+		t.Errorf("Expected 10 sentences sent at the detected rate got %d", got)
+	}
+}
+
+func TestSerialBaudAutoDegraded(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	if err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Baud_auto_config); err != nil {
+		t.Fatalf("Config. Failed to load err: %s", err)
+	}
+	// valid sentences followed by garbage as if the instrument changed its rate
+	m := &mockSerialDevice{baudData: map[int]string{
+		38400: baudSentences("$HCHDM,172.5,M", 10) + strings.Repeat("\xfe~\x13\x80\xf8\r\n", 30),
+	}}
+	n.SerialIoDevices["compass"] = m
+	n.monitor_active = true
+	n.RunDevice("compass", n.devices["compass"])
+	time.Sleep(300 * time.Millisecond)
+	n.Shutdown(context.Background())
+	messages := test_helpers.GetMessages(monitor)
+
+	expected := []string{
+		"Serial device compass baud rate detected as 38400 from 10 valid sentences",
+		"Serial device compass sentences from /dev/ttyUSB0 are mostly invalid - detecting baud rate again",
+		"Serial device compass baud rate detected as 38400 from 10 valid sentences",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+	if reconnects := n.deviceStats("compass").reconnects.Load(); reconnects != 0 {
+		t.Errorf("Expected detecting the baud rate again not to count as a reconnect got %d", reconnects)
+	}
+}
+
+func TestSerialBaudErrors(t *testing.T) {
+	n := NewMux()
+	err := n.LoadConfig("./test_data/", "config", "yaml", test_data.Bad_baud_config)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Config. Expected config errors got: %s", err)
+	}
+	expected := []string{
+		"compass: baud_candidates fast is not a baud rate",
+		"compass: baud_window 0 must be a number of ms greater than 0",
+		"gps: baud_candidates and baud_window are only used with baud: auto",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors got %s", len(expected), err)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("Expected error %s got %s", e, errs[i].Error())
+		}
+	}
+}
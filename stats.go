@@ -0,0 +1,278 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic counts for a device since the mux was created
+type DeviceStats struct {
+	SentencesIn    int64 // read from a port or input channel
+	SentencesOut   int64 // written to a port or put on an output channel
+	BytesIn        int64
+	BytesOut       int64
+	ParseErrors    int64 // bad or over long sentences
+	ChecksumErrors int64 // dropped by the checksum setting
+	Dropped        int64 // not put on an output channel because it was full
+	Reconnects     int64 // times a lost port or connection was opened again
+	Duplicates     int64 // dropped by a dedup device as seen within its window
+	Replaced       int64 // held by a throttle device and dropped for a newer one
+}
+
+// The number of sentences waiting in a channel. HighWater is the most
+// seen waiting since the mux was created, sampled every 100ms. Dropped
+// counts the sentences lost by the channel's policy when it was full.
+type ChannelStats struct {
+	Depth     int
+	Capacity  int
+	HighWater int
+	Dropped   int64
+}
+
+type Stats struct {
+	Devices  map[string]DeviceStats
+	Channels map[string]ChannelStats
+}
+
+// Counts kept by a device's go routines. Methods do nothing on a nil
+// deviceStats so that go routines can be tested without a mux.
+type deviceStats struct {
+	sentences_in    atomic.Int64
+	sentences_out   atomic.Int64
+	bytes_in        atomic.Int64
+	bytes_out       atomic.Int64
+	parse_errors    atomic.Int64
+	checksum_errors atomic.Int64
+	dropped         atomic.Int64
+	reconnects      atomic.Int64
+	duplicates      atomic.Int64
+	replaced        atomic.Int64
+	sentences_mu    sync.Mutex
+	sentences       map[sentenceKey](*sentenceCount)
+	policies        *channelPolicies // of the channels the device sends to
+}
+
+// Sentences received by a device are counted by talker and type
+type sentenceKey struct {
+	talker        string
+	sentence_type string
+}
+
+type sentenceCount struct {
+	count int64
+	last  time.Time
+}
+
+func (s *deviceStats) received(str string) {
+	if s == nil {
+		return
+	}
+	s.sentences_in.Add(1)
+	s.bytes_in.Add(int64(len(str)))
+
+	_, sentence := trim_tag(str)
+	talker, sentence_type := sentenceAddress(sentence)
+	if sentence_type == "" {
+		return
+	}
+	key := sentenceKey{talker: talker, sentence_type: sentence_type}
+	s.sentences_mu.Lock()
+	defer s.sentences_mu.Unlock()
+	if s.sentences == nil {
+		s.sentences = make(map[sentenceKey](*sentenceCount))
+	}
+	count, found := s.sentences[key]
+	if !found {
+		count = &sentenceCount{}
+		s.sentences[key] = count
+	}
+	count.count++
+	count.last = time.Now()
+}
+
+func (s *deviceStats) sent(str string) {
+	if s != nil {
+		s.sentences_out.Add(1)
+		s.bytes_out.Add(int64(len(str)))
+	}
+}
+
+func (s *deviceStats) parseError() {
+	if s != nil {
+		s.parse_errors.Add(1)
+	}
+}
+
+func (s *deviceStats) reconnected() {
+	if s != nil {
+		s.reconnects.Add(1)
+	}
+}
+
+func (s *deviceStats) checksumError() {
+	if s != nil {
+		s.checksum_errors.Add(1)
+	}
+}
+
+func (s *deviceStats) duplicate() {
+	if s != nil {
+		s.duplicates.Add(1)
+	}
+}
+
+func (s *deviceStats) replace() {
+	if s != nil {
+		s.replaced.Add(1)
+	}
+}
+
+// Puts str on channel following the channel's policy when it is full,
+// returning false if it was dropped
+func (s *deviceStats) send(ctx context.Context, channel chan string, str string) bool {
+	var policies *channelPolicies
+	if s != nil {
+		policies = s.policies
+	}
+	if !policies.send(ctx, channel, str) {
+		if s != nil {
+			s.dropped.Add(1)
+		}
+		return false
+	}
+	s.sent(str)
+	return true
+}
+
+func (s *deviceStats) snapshot() DeviceStats {
+	return DeviceStats{
+		SentencesIn:    s.sentences_in.Load(),
+		SentencesOut:   s.sentences_out.Load(),
+		BytesIn:        s.bytes_in.Load(),
+		BytesOut:       s.bytes_out.Load(),
+		ParseErrors:    s.parse_errors.Load(),
+		ChecksumErrors: s.checksum_errors.Load(),
+		Dropped:        s.dropped.Load(),
+		Reconnects:     s.reconnects.Load(),
+		Duplicates:     s.duplicates.Load(),
+		Replaced:       s.replaced.Load(),
+	}
+}
+
+// Returns a copy of the counts by talker and sentence type
+func (s *deviceStats) sentenceCounts() map[sentenceKey]sentenceCount {
+	s.sentences_mu.Lock()
+	defer s.sentences_mu.Unlock()
+	counts := make(map[sentenceKey]sentenceCount, len(s.sentences))
+	for key, count := range s.sentences {
+		counts[key] = *count
+	}
+	return counts
+}
+
+// Returns the counts for the named device creating them on first use.
+// Counts are kept when a device is restarted by a config reload.
+func (n *NmeaMux) deviceStats(name string) *deviceStats {
+	n.stats_mu.Lock()
+	defer n.stats_mu.Unlock()
+	stats, found := n.stats[name]
+	if !found {
+		stats = &deviceStats{policies: n.policies}
+		n.stats[name] = stats
+	}
+	return stats
+}
+
+// Returns the traffic counts of every device which has run and the
+// current depth of every channel
+func (n *NmeaMux) Stats() Stats {
+	n.sampleChannels()
+	stats := Stats{
+		Devices:  make(map[string]DeviceStats),
+		Channels: make(map[string]ChannelStats),
+	}
+	n.stats_mu.Lock()
+	defer n.stats_mu.Unlock()
+	for name, s := range n.stats {
+		stats.Devices[name] = s.snapshot()
+	}
+	for name, c := range n.channel_stats {
+		stats.Channels[name] = c
+	}
+	return stats
+}
+
+// Records the depth of each channel and its high water mark
+func (n *NmeaMux) sampleChannels() {
+	n.channels_mu.Lock()
+	depths := make(map[string]ChannelStats, len(n.Channels))
+	for name, channel := range n.Channels {
+		depths[name] = ChannelStats{Depth: len(channel), Capacity: cap(channel)}
+	}
+	n.channels_mu.Unlock()
+	dropped := n.policies.dropped()
+
+	n.stats_mu.Lock()
+	defer n.stats_mu.Unlock()
+	for name, c := range depths {
+		c.Dropped = dropped[name]
+		c.HighWater = max(c.Depth, n.channel_stats[name].HighWater)
+		n.channel_stats[name] = c
+	}
+}
+
+// Samples the channels until ctx is done sending the stats to the
+// monitor every period if it is set
+func (n *NmeaMux) statsSampler(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	last_report := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			n.sampleChannels()
+			if period > 0 && time.Since(last_report) >= period {
+				last_report = time.Now()
+				for _, str := range n.statsReport() {
+					n.logger.Info(str)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns a line for each device and channel sorted by name
+func (n *NmeaMux) statsReport() []string {
+	stats := n.Stats()
+	report := make([]string, 0, len(stats.Devices)+len(stats.Channels))
+	for _, name := range sortedKeys(stats.Devices) {
+		d := stats.Devices[name]
+		report = append(report, fmt.Sprintf("Stats device %s in: %d (%d bytes) out: %d (%d bytes) parse errors: %d checksum errors: %d dropped: %d reconnects: %d duplicates: %d replaced: %d",
+			name, d.SentencesIn, d.BytesIn, d.SentencesOut, d.BytesOut, d.ParseErrors, d.ChecksumErrors, d.Dropped, d.Reconnects, d.Duplicates, d.Replaced))
+	}
+	for _, name := range sortedKeys(stats.Channels) {
+		c := stats.Channels[name]
+		report = append(report, fmt.Sprintf("Stats channel %s depth: %d/%d high water: %d dropped: %d", name, c.Depth, c.Capacity, c.HighWater, c.Dropped))
+	}
+	return report
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestStatsDevice(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Dedup_config)
+	n.monitor_active = true
+	if err := n.RunDevice("opencpn_dedup", n.devices["opencpn_dedup"]); err != nil {
+		t.Errorf("Dedup failed to start %s", err)
+	}
+	n.Channels["to_dedup"] <- "$IIDPT,5.2,0.5*42"
+	n.Channels["to_dedup"] <- "$SDDPT,5.2,0.5*5E"
+	n.Channels["to_dedup"] <- "$IIDPT,5.3,0.5*43"
+	test_helpers.GetMessages(monitor)
+
+	stats := n.Stats()
+	dedup := stats.Devices["opencpn_dedup"]
+	if dedup.SentencesIn != 3 || dedup.SentencesOut != 2 || dedup.BytesIn != 51 || dedup.BytesOut != 34 || dedup.Dropped != 0 ||
+		dedup.Duplicates != 1 {
+		t.Errorf("Expected 3 in 2 out and 1 duplicate got %+v", dedup)
+	}
+	out := stats.Channels["to_udp_opencpn"]
+	if out.Depth != 2 || out.Capacity != 30 || out.HighWater != 2 {
+		t.Errorf("Expected 2 waiting in channel got %+v", out)
+	}
+
+	test_helpers.GetMessages(n.Channels["to_udp_opencpn"])
+	out = n.Stats().Channels["to_udp_opencpn"]
+	if out.Depth != 0 || out.HighWater != 2 {
+		t.Errorf("Expected empty channel with high water 2 got %+v", out)
+	}
+
+	expected := []string{
+		"Stats device opencpn_dedup in: 3 (51 bytes) out: 2 (34 bytes) parse errors: 0 checksum errors: 0 dropped: 0 reconnects: 0 duplicates: 1 replaced: 0",
+		"Stats channel to_udp_opencpn depth: 0/30 high water: 2 dropped: 0",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected, n.statsReport()); not_found {
+		t.Errorf("Stats report error %s", err)
+	}
+}
+
+func TestStatsDropped(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Dedup_config)
+	n.monitor_active = true
+	for i := 0; i < 30; i++ {
+		n.Channels["to_udp_opencpn"] <- "full"
+	}
+	n.RunDevice("opencpn_dedup", n.devices["opencpn_dedup"])
+	n.Channels["to_dedup"] <- "$IIDPT,5.2,0.5*42"
+	n.Channels["to_dedup"] <- "$IIDPT,5.3,0.5*43"
+	test_helpers.GetMessages(monitor)
+
+	stats := n.Stats()
+	if dropped := stats.Devices["opencpn_dedup"].Dropped; dropped != 2 {
+		t.Errorf("Expected 2 dropped got %d", dropped)
+	}
+	if high := stats.Channels["to_udp_opencpn"].HighWater; high != 30 {
+		t.Errorf("Expected high water 30 got %d", high)
+	}
+}
+
+func TestStatsChecksumErrors(t *testing.T) {
+	n := NewMux()
+	n.LoadConfigFromMap(map[string]any{
+		"gps": map[string]any{"type": "udp_listen", "port": "8006", "checksum": "require", "outputs": []string{"to_processor"}},
+	})
+	c := n.newChecksumFilter("gps")
+	c.filter("$GPGLL,5057.970,N,00146.110,E,142451,A*00")
+	c.filter("$GPGLL,5057.970,N,00146.110,E,142451,A")
+	if errors := n.Stats().Devices["gps"].ChecksumErrors; errors != 2 {
+		t.Errorf("Expected 2 checksum errors got %d", errors)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// A tap sits between the devices writing to a channel and the channel so
+// that sentences can be watched without taking them from the device reading it
+type channelTap struct {
+	in     chan string
+	copies [](chan string)
+}
+
+// A tap of a channel served to clients by a tcp server with a tap setting
+type serverTap struct {
+	channel string
+	tail    chan string
+}
+
+// Returns a channel receiving a copy of every sentence sent to the named
+// channel, eg to tail the traffic. Must be called before Run. Copies are
+// dropped if they are not read quickly enough.
+func (n *NmeaMux) Tap(channel string) (<-chan string, error) {
+	n.channels_mu.Lock()
+	defer n.channels_mu.Unlock()
+	return n.tap(channel)
+}
+
+// Must be called with channels_mu held
+func (n *NmeaMux) tap(channel string) (chan string, error) {
+	if _, found := n.Channels[channel]; !found {
+		return nil, fmt.Errorf("channel %s is not in the config", channel)
+	}
+	if n.started {
+		return nil, fmt.Errorf("channel %s must be tapped before the mux is run", channel)
+	}
+	tap, found := n.taps[channel]
+	if !found {
+		tap = &channelTap{in: make(chan string, cap(n.Channels[channel]))}
+		n.policies.share(tap.in, n.Channels[channel])
+		n.taps[channel] = tap
+	}
+	tail := make(chan string, 100)
+	tap.copies = append(tap.copies, tail)
+	return tail, nil
+}
+
+// Taps the channels given in the tap setting of tcp servers so that a
+// running mux can be tailed, eg by nmea_mux tail, without taking sentences
+// from the device reading the channel. Called before the mux starts.
+func (n *NmeaMux) tapServers() {
+	errs := make(map[string]error)
+	n.channels_mu.Lock()
+	for _, name := range n.Config.TypeList["tcp_server"] {
+		taps := n.Config.Values[name]["tap"]
+		if _, found := n.server_taps[name]; found || len(taps) != 1 {
+			continue
+		}
+		tail, err := n.tap(taps[0])
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		n.server_taps[name] = serverTap{channel: taps[0], tail: tail}
+	}
+	n.channels_mu.Unlock()
+	for name, err := range errs {
+		n.deviceLogger(name).Error(fmt.Sprintf("Tcp server <%s> cannot tap: %s", name, err))
+	}
+}
+
+// Returns the tap made for the named tcp server when the mux started
+func (n *NmeaMux) serverTap(name string) (serverTap, bool) {
+	n.channels_mu.Lock()
+	defer n.channels_mu.Unlock()
+	tap, found := n.server_taps[name]
+	return tap, found
+}
+
+func (n *NmeaMux) startTaps() {
+	n.channels_mu.Lock()
+	defer n.channels_mu.Unlock()
+	for channel, tap := range n.taps {
+		out := n.Channels[channel]
+		n.goDevice("tap_"+channel, func(ctx context.Context) {
+			channelTee(ctx, channel, tap, out, n.policies, n.deviceLogger("tap_"+channel))
+		})
+	}
+}
+
+func channelTee(ctx context.Context, channel string, tap *channelTap, out chan string, policies *channelPolicies, log *slog.Logger) {
+	for {
+		select {
+		case str := <-tap.in:
+			if !policies.send(ctx, out, str) {
+				log.Warn("Sentence could not be put on channel - may be full", "channel", channel, "sentence", str)
+			}
+			for _, tail := range tap.copies {
+				select {
+				case tail <- str:
+				default:
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
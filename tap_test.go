@@ -0,0 +1,40 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"testing"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestTapChannel(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Dedup_config)
+	n.monitor_active = true
+	if _, err := n.Tap("not_a_channel"); err == nil {
+		t.Error("Tapping an unknown channel must fail")
+	}
+	tail, err := n.Tap("to_udp_opencpn")
+	if err != nil {
+		t.Fatalf("Tap failed: %s", err)
+	}
+	n.RunContext(context.Background())
+	defer n.Shutdown(context.Background())
+	if _, err := n.Tap("to_dedup"); err == nil {
+		t.Error("Tapping after run must fail")
+	}
+
+	n.Channels["to_dedup"] <- "$IIDPT,5.2,0.5*42"
+	if received := test_helpers.GetMessages(n.Channels["to_udp_opencpn"]); len(received) != 1 {
+		t.Errorf("Tapped channel must still receive sentences got %v", received)
+	}
+	if copied := test_helpers.GetMessages(tail); len(copied) != 1 || copied[0] != "$IIDPT,5.2,0.5*42" {
+		t.Errorf("Tap must receive a copy got %v", copied)
+	}
+}
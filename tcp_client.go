@@ -0,0 +1,168 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/io"
+)
+
+type tcpClientSettings struct {
+	server_address string
+	input          string
+	outputs        []string
+	tag            string
+	max_backoff    time.Duration
+	checksum       *checksumFilter
+	stats          *deviceStats
+	report_tx      bool
+	report_rx      bool
+}
+
+func (n *NmeaMux) tcpClientProcess(name string) error {
+	// connects to a tcp server such as a WiFi NMEA gateway, reconnecting when the link drops
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	settings := tcpClientSettings{
+		outputs:     config["outputs"],
+		max_backoff: 30 * time.Second,
+	}
+	bad_config := false
+
+	if server_addrs, found := config["server_address"]; found && len(server_addrs) == 1 {
+		settings.server_address = server_addrs[0]
+	} else {
+		log.Error(fmt.Sprintf("Tcp client <%s> has invalid number of server addresses must be exactly 1", name))
+		bad_config = true
+	}
+
+	if inputs, found := config["input"]; found {
+		if len(inputs) == 1 {
+			settings.input = inputs[0]
+		} else {
+			log.Error(fmt.Sprintf("Tcp client <%s> has invalid number of inputs must be exactly 1", name))
+			bad_config = true
+		}
+	}
+
+	if max_backoffs, found := config["max_backoff"]; found {
+		seconds := 0
+		if len(max_backoffs) == 1 {
+			seconds, _ = strconv.Atoi(max_backoffs[0])
+		}
+		if seconds > 0 {
+			settings.max_backoff = time.Duration(seconds) * time.Second
+		} else {
+			log.Error(fmt.Sprintf("Tcp client <%s> max_backoff must be a number of seconds greater than 0", name))
+			bad_config = true
+		}
+	}
+
+	if origin_tags, found := config["origin_tag"]; found {
+		if len(origin_tags) > 0 {
+			settings.tag = fmt.Sprintf("@%s@", origin_tags[0])
+		}
+	}
+
+	if reports, found := config["report"]; found {
+		for _, v := range reports {
+			switch v {
+			case "tx":
+				settings.report_tx = true
+			case "rx":
+				settings.report_rx = true
+			case "on":
+				settings.report_tx = true
+				settings.report_rx = true
+			}
+		}
+	}
+
+	if !bad_config {
+		settings.checksum = n.newChecksumFilter(name)
+		settings.stats = n.deviceStats(name)
+		log.Info(fmt.Sprintf("Started tcp client %s connecting to %s", name, settings.server_address))
+		tcp := n.TcpClientIoDevices[name]
+		n.goDevice(name, func(ctx context.Context) {
+			tcpClient(ctx, name, tcp, settings, n.deviceLogger(name), n.deviceChannels(name))
+		})
+	}
+	return nil
+}
+
+// Keeps a connection to the server open, retrying with a doubling backoff
+// up to max_backoff whenever it cannot connect or the link drops
+func tcpClient(ctx context.Context, name string, tcp io.TcpClient_interfacer, settings tcpClientSettings,
+	log *slog.Logger, channels *map[string](chan string)) {
+	backoff := time.Second
+	connected := false
+	for {
+		if err := tcp.Open(settings.server_address); err != nil {
+			log.Warn(fmt.Sprintf("Could not connect tcp client %s to %s error: %s - retry in %s",
+				name, settings.server_address, err, backoff))
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, settings.max_backoff)
+			continue
+		}
+		backoff = time.Second
+		if connected {
+			settings.stats.reconnected()
+		}
+		connected = true
+		log.Info(fmt.Sprintf("Tcp client %s connected to %s from %s", name, tcp.RemoteAddr(), tcp.LocalAddr()))
+
+		tcpClientSession(ctx, name, tcp, settings, log, channels)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn(fmt.Sprintf("Tcp client %s disconnected from %s", name, settings.server_address))
+	}
+}
+
+// Reads and writes sentences on an open connection until it fails or ctx is done
+func tcpClientSession(ctx context.Context, name string, tcp io.TcpClient_interfacer, settings tcpClientSettings,
+	log *slog.Logger, channels *map[string](chan string)) {
+	read_done := make(chan struct{})
+	go func() {
+		tcpReader(ctx, name, tcp, settings.outputs, settings.tag, settings.checksum, settings.stats, log, channels, settings.report_rx)
+		close(read_done)
+	}()
+	defer func() {
+		tcp.Close()
+		<-read_done
+	}()
+
+	var in chan string // nil channel never receives when there is no input
+	if settings.input != "" {
+		in = (*channels)[settings.input]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-read_done:
+			return
+		case str := <-in:
+			settings.stats.received(str)
+			_, str = trim_tag(str)
+			if settings.report_tx {
+				log.Debug(fmt.Sprintf("Tcp %s Tx:  %s", name, str), "category", category_device)
+			}
+			if _, err := tcp.Write([]byte(str + "\r\n")); err != nil {
+				log.Error(fmt.Sprintf("Tcp %s write error: %s", name, err))
+				return
+			}
+			settings.stats.sent(str)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+type mockTcpClientDevice struct {
+	server_address string
+	open_fails     int
+	mu             sync.Mutex
+	conn           *mockTcpConn
+	opened         chan *mockTcpConn
+}
+
+func (m *mockTcpClientDevice) Open(server_address string) error {
+	m.server_address = server_address
+	if m.open_fails > 0 {
+		m.open_fails--
+		return errors.New("mock connection refused")
+	}
+	m.mu.Lock()
+	m.conn = newMockTcpConn(server_address)
+	m.mu.Unlock()
+	m.opened <- m.conn
+	return nil
+}
+
+func (m *mockTcpClientDevice) current() *mockTcpConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+func (m *mockTcpClientDevice) Close() error {
+	return m.current().Close()
+}
+
+func (m *mockTcpClientDevice) LocalAddr() string {
+	return "127.0.0.1:9000"
+}
+
+func (m *mockTcpClientDevice) RemoteAddr() string {
+	return m.server_address
+}
+
+func (m *mockTcpClientDevice) Read(buff *[]byte) (int, error) {
+	return m.current().Read(buff)
+}
+
+func (m *mockTcpClientDevice) Write(buff []byte) (int, error) {
+	return m.current().Write(buff)
+}
+
+func TestTcpClientMockReconnect(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_config)
+	name := "tcp_gateway"
+	m := &mockTcpClientDevice{
+		open_fails: 1,
+		opened:     make(chan *mockTcpConn, 2),
+	}
+	n.TcpClientIoDevices[name] = m
+	n.monitor_active = true
+	n.RunDevice(name, n.devices[name])
+
+	conn := <-m.opened
+	conn.reads <- []byte("$IIDPT,5.2,0.5*42\r\n")
+	received := test_helpers.GetMessages(n.Channels["to_tcp"])
+	if len(received) != 1 || received[0] != "@gw_@$IIDPT,5.2,0.5*42" {
+		t.Errorf("Expected tagged sentence from gateway got %s", received)
+	}
+
+	send := "$HFHDM,200.5,M*2B"
+	n.Channels["from_tcp"] <- send
+	time.Sleep(50 * time.Millisecond)
+	if conn.Sent() != send+"\r\n" {
+		t.Errorf("Should have sent <%s> but got <%s>", send, conn.Sent())
+	}
+
+	// drop the link and expect a new connection
+	conn.Close()
+	select {
+	case <-m.opened:
+	case <-time.After(2 * time.Second):
+		t.Error("Tcp client did not reconnect")
+	}
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Started tcp client tcp_gateway connecting to 192.168.1.30:10110",
+		"Could not connect tcp client tcp_gateway to 192.168.1.30:10110 error: mock connection refused - retry in 1s",
+		"Tcp client tcp_gateway connected to 192.168.1.30:10110 from 127.0.0.1:9000",
+		"Tcp client tcp_gateway disconnected from 192.168.1.30:10110",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+}
+
+func TestTcpClientEmptyMaxBackoff(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_config)
+	name := "tcp_gateway"
+	n.Config.Values[name]["max_backoff"] = []string{}
+	n.TcpClientIoDevices[name] = &mockTcpClientDevice{opened: make(chan *mockTcpConn, 1)}
+	n.monitor_active = true
+	n.RunDevice(name, n.devices[name])
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{"Tcp client <tcp_gateway> max_backoff must be a number of seconds greater than 0"}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
@@ -0,0 +1,315 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/martinmarsh/nmea-mux/io"
+)
+
+// Sentences queued for each client so that a slow client does not hold up the others
+const tcp_client_queue = 30
+
+// Connected clients of a tcp server keyed by remote address
+type tcpClients struct {
+	mu    sync.Mutex
+	conns map[string](*tcpServerClient)
+}
+
+type tcpServerClient struct {
+	conn io.TcpConn_interfacer
+	out  chan string   // sentences waiting to be written by the client's writer
+	done chan struct{} // closed when the client's reader exits
+}
+
+type tcpServerSettings struct {
+	port        string
+	input       string
+	tap         serverTap // sent to clients in place of an input
+	outputs     []string
+	tag         string
+	client_tags map[string]string
+	max_clients int
+	report_tx   bool
+	report_rx   bool
+}
+
+func (n *NmeaMux) tcpServerProcess(name string) error {
+	// listens on a port for clients such as chart plotter apps. Sentences from the
+	// input channel are sent to every client and sentences sent by clients are
+	// written to the output channels
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	settings := tcpServerSettings{
+		outputs:     config["outputs"],
+		client_tags: make(map[string]string),
+		max_clients: 10,
+	}
+	bad_config := false
+
+	if ports, found := config["port"]; found && len(ports) == 1 {
+		settings.port = ports[0]
+	} else {
+		log.Error(fmt.Sprintf("Tcp server <%s> must have exactly 1 port", name))
+		bad_config = true
+	}
+
+	if inputs, found := config["input"]; found {
+		if len(inputs) == 1 {
+			settings.input = inputs[0]
+		} else {
+			log.Error(fmt.Sprintf("Tcp server <%s> has invalid number of inputs must be exactly 1", name))
+			bad_config = true
+		}
+	}
+
+	if taps, found := config["tap"]; found {
+		if tap, tapped := n.serverTap(name); len(taps) != 1 || settings.input != "" {
+			log.Error(fmt.Sprintf("Tcp server <%s> must tap exactly 1 channel and have no input", name))
+			bad_config = true
+		} else if !tapped || tap.channel != taps[0] {
+			log.Error(fmt.Sprintf("Tcp server <%s> tap of %s is made when the mux starts - restart the mux", name, taps[0]))
+			bad_config = true
+		} else {
+			settings.tap = tap
+		}
+	}
+
+	if max_clients, found := config["max_clients"]; found {
+		max_c := 0
+		if len(max_clients) == 1 {
+			max_c, _ = strconv.Atoi(max_clients[0])
+		}
+		if max_c > 0 {
+			settings.max_clients = max_c
+		} else {
+			log.Error(fmt.Sprintf("Tcp server <%s> max_clients must be a number greater than 0", name))
+			bad_config = true
+		}
+	}
+
+	if origin_tags, found := config["origin_tag"]; found {
+		if len(origin_tags) > 0 {
+			settings.tag = fmt.Sprintf("@%s@", origin_tags[0])
+		}
+	}
+
+	// client_tags are in the form "192.168.1.20 == ipad_" to tag sentences from a client address
+	for _, client_tag := range config["client_tags"] {
+		z := strings.Split(client_tag, "==")
+		if len(z) == 2 {
+			settings.client_tags[strings.TrimSpace(z[0])] = fmt.Sprintf("@%s@", strings.TrimSpace(z[1]))
+		} else {
+			log.Error(fmt.Sprintf("Tcp server <%s> client tag <%s> must be in the form address == tag", name, client_tag))
+			bad_config = true
+		}
+	}
+
+	if reports, found := config["report"]; found {
+		for _, v := range reports {
+			switch v {
+			case "tx":
+				settings.report_tx = true
+			case "rx":
+				settings.report_rx = true
+			case "on":
+				settings.report_tx = true
+				settings.report_rx = true
+			}
+		}
+	}
+
+	if !bad_config {
+		server := n.TcpServerIoDevices[name]
+		n.goDevice(name, func(ctx context.Context) {
+			n.tcpServer(ctx, name, server, settings)
+		})
+	}
+	return nil
+}
+
+func (n *NmeaMux) tcpServer(ctx context.Context, name string, server io.TcpServer_interfacer, settings tcpServerSettings) {
+	log := n.deviceLogger(name)
+	err := server.Listen(settings.port)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error; Tcp_server %s; action: ABORTED, error: %s", name, err.Error()))
+		return
+	}
+	log.Info(fmt.Sprintf("Started Tcp_server; name: %s  Port: %s max clients: %d", name, settings.port, settings.max_clients))
+
+	clients := &tcpClients{conns: make(map[string](*tcpServerClient))}
+	checksum := n.newChecksumFilter(name)
+	stats := n.deviceStats(name)
+	n.onStop(name, func() {
+		server.Close()
+		clients.mu.Lock()
+		defer clients.mu.Unlock()
+		for _, client := range clients.conns {
+			client.conn.Close()
+		}
+	})
+
+	if settings.input != "" {
+		n.goDevice(name, func(ctx context.Context) {
+			tcpBroadcaster(ctx, name, clients, settings.input, stats, n.deviceLogger(name), n.deviceChannels(name), settings.report_tx)
+		})
+	} else if settings.tap.tail != nil {
+		tapped := map[string](chan string){settings.tap.channel: settings.tap.tail}
+		n.goDevice(name, func(ctx context.Context) {
+			tcpBroadcaster(ctx, name, clients, settings.tap.channel, stats, n.deviceLogger(name), &tapped, settings.report_tx)
+		})
+	}
+
+	for {
+		conn, err := server.Accept()
+		if ctx.Err() != nil {
+			// closed on shutdown
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Error; Tcp_server %s; Accept Error; action: ABORTED, error: %s", name, err.Error()))
+			return
+		}
+		addr := conn.RemoteAddr()
+		client := &tcpServerClient{conn: conn, out: make(chan string, tcp_client_queue), done: make(chan struct{})}
+
+		clients.mu.Lock()
+		full := len(clients.conns) >= settings.max_clients
+		if !full {
+			clients.conns[addr] = client
+		}
+		clients.mu.Unlock()
+
+		if full {
+			log.Warn(fmt.Sprintf("Tcp server %s rejected client %s - max clients %d reached", name, addr, settings.max_clients))
+			conn.Close()
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Tcp server %s client %s connected", name, addr))
+		tag := settings.tag
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if client_tag, found := settings.client_tags[host]; found {
+				tag = client_tag
+			}
+		}
+		n.goDevice(name, func(ctx context.Context) {
+			tcpClientWriter(ctx, name, addr, client, stats, n.deviceLogger(name))
+		})
+		n.goDevice(name, func(ctx context.Context) {
+			tcpReader(ctx, name, conn, settings.outputs, tag, checksum, stats, n.deviceLogger(name), n.deviceChannels(name), settings.report_rx)
+			clients.mu.Lock()
+			delete(clients.conns, addr)
+			clients.mu.Unlock()
+			close(client.done)
+			conn.Close()
+			if ctx.Err() == nil {
+				log.Warn(fmt.Sprintf("Tcp server %s client %s disconnected", name, addr))
+			}
+		})
+	}
+}
+
+// Queues each sentence on the input channel for every connected client. A
+// client whose queue is full misses the sentence rather than holding up
+// the others.
+func tcpBroadcaster(ctx context.Context, name string, clients *tcpClients, input string, stats *deviceStats, log *slog.Logger,
+	channels *map[string](chan string), report_tx bool) {
+	for {
+		var str string
+		select {
+		case str = <-(*channels)[input]:
+		case <-ctx.Done():
+			return
+		}
+		stats.received(str)
+		_, str = trim_tag(str)
+		if report_tx {
+			log.Debug(fmt.Sprintf("Tcp %s Tx:  %s", name, str), "category", category_device)
+		}
+		clients.mu.Lock()
+		for addr, client := range clients.conns {
+			select {
+			case client.out <- str:
+			default:
+				log.Warn(fmt.Sprintf("Tcp %s client %s is not keeping up - sentence dropped", name, addr), "sentence", str)
+			}
+		}
+		clients.mu.Unlock()
+	}
+}
+
+// Writes the sentences queued for a client until a write fails, the
+// client disconnects or ctx is done
+func tcpClientWriter(ctx context.Context, name string, addr string, client *tcpServerClient, stats *deviceStats, log *slog.Logger) {
+	for {
+		var str string
+		select {
+		case str = <-client.out:
+		case <-client.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if _, err := client.conn.Write([]byte(str + "\r\n")); err != nil {
+			log.Error(fmt.Sprintf("Tcp %s write error to client %s: %s", name, addr, err))
+			// closing makes the client reader exit and remove the client
+			client.conn.Close()
+			return
+		}
+		stats.sent(str)
+	}
+}
+
+// Reads CR, LF or CRLF terminated sentences from a tcp connection until it is closed
+func tcpReader(ctx context.Context, name string, conn io.TcpConn_interfacer, outputs []string, tag string,
+	checksum *checksumFilter, stats *deviceStats, log *slog.Logger, channels *map[string](chan string), report_rx bool) {
+	buff := make([]byte, 256)
+	framer := newLineFramer(max_line_len)
+	for {
+		n, err := conn.Read(&buff)
+		if ctx.Err() != nil || err != nil || n == 0 {
+			return
+		}
+		framer.write(buff[:n])
+		for {
+			line, err := framer.next()
+			if err != nil {
+				log.Error(fmt.Sprintf("Tcp read error in %s error %s", name, err))
+				stats.parseError()
+				continue
+			}
+			if line == nil {
+				break
+			}
+			str := string(line)
+			stats.received(str)
+			var ok bool
+			if str, ok = checksum.filter(str); !ok {
+				continue
+			}
+			str = tag + str
+			if report_rx {
+				log.Debug(fmt.Sprintf("Tcp %s Rx:  %s", name, str), "category", category_device)
+			}
+			for _, out := range outputs {
+				if !stats.send(ctx, (*channels)[out], str) {
+					log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+				}
+			}
+		}
+	}
+}
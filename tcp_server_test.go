@@ -0,0 +1,263 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/io"
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+type mockTcpConn struct {
+	addr   string
+	mu     sync.Mutex
+	sent   string
+	reads  chan []byte
+	closed chan bool
+	once   sync.Once
+	stall  chan bool // if set writes wait until it or the connection is closed
+}
+
+func newMockTcpConn(addr string) *mockTcpConn {
+	return &mockTcpConn{
+		addr:   addr,
+		reads:  make(chan []byte, 10),
+		closed: make(chan bool),
+	}
+}
+
+func (m *mockTcpConn) Read(buff *[]byte) (int, error) {
+	select {
+	case b := <-m.reads:
+		return copy(*buff, b), nil
+	case <-m.closed:
+		return 0, errors.New("mock connection closed")
+	}
+}
+
+func (m *mockTcpConn) Write(buff []byte) (int, error) {
+	if m.stall != nil {
+		select {
+		case <-m.stall:
+		case <-m.closed:
+			return 0, errors.New("mock connection closed")
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent += string(buff)
+	return len(buff), nil
+}
+
+func (m *mockTcpConn) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+func (m *mockTcpConn) RemoteAddr() string {
+	return m.addr
+}
+
+func (m *mockTcpConn) Sent() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent
+}
+
+type mockTcpServerDevice struct {
+	server_port string
+	conns       chan *mockTcpConn
+	closed      chan bool
+	once        sync.Once
+}
+
+func (m *mockTcpServerDevice) Listen(server_port string) error {
+	m.server_port = server_port
+	return nil
+}
+
+func (m *mockTcpServerDevice) Accept() (io.TcpConn_interfacer, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.closed:
+		return nil, errors.New("mock server closed")
+	}
+}
+
+func (m *mockTcpServerDevice) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+func TestTcpServerMockClients(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_config)
+	name := "tcp_opencpn"
+	m := &mockTcpServerDevice{
+		conns:  make(chan *mockTcpConn, 3),
+		closed: make(chan bool),
+	}
+	n.TcpServerIoDevices[name] = m
+	n.monitor_active = true
+	n.RunDevice(name, n.devices[name])
+
+	ipad := newMockTcpConn("192.168.1.20:50001")
+	laptop := newMockTcpConn("192.168.1.21:50002")
+	extra := newMockTcpConn("192.168.1.22:50003")
+	m.conns <- ipad
+	m.conns <- laptop
+	m.conns <- extra
+	time.Sleep(100 * time.Millisecond)
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Started Tcp_server; name: tcp_opencpn  Port: 10110 max clients: 2",
+		"Tcp server tcp_opencpn client 192.168.1.20:50001 connected",
+		"Tcp server tcp_opencpn client 192.168.1.21:50002 connected",
+		"Tcp server tcp_opencpn rejected client 192.168.1.22:50003 - max clients 2 reached",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+
+	send := "$HFHDM,200.5,M*2B"
+	n.Channels["to_tcp"] <- "@cp_@" + send
+	time.Sleep(100 * time.Millisecond)
+	if ipad.Sent() != send+"\r\n" || laptop.Sent() != send+"\r\n" {
+		t.Errorf("Should have broadcast <%s> got <%s> and <%s>", send, ipad.Sent(), laptop.Sent())
+	}
+
+	ipad.reads <- []byte("$ECAPB,A,A,0.10,R,N,V,V,011,M,DEST,011,M,011,M*2D\r\n")
+	laptop.reads <- []byte("$ECAPB,A,A,0.20,R,N,V,V,011,M,DEST,011,M,011,M*2E\r\n")
+	received := test_helpers.GetMessages(n.Channels["from_tcp"])
+	expected_messages = []string{
+		"@ipad_@$ECAPB,A,A,0.10",
+		"@tcp_@$ECAPB,A,A,0.20",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, received); not_found {
+		t.Errorf("From tcp channel error %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+}
+
+func TestTcpServerStalledClient(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_config)
+	name := "tcp_opencpn"
+	m := &mockTcpServerDevice{
+		conns:  make(chan *mockTcpConn, 2),
+		closed: make(chan bool),
+	}
+	n.TcpServerIoDevices[name] = m
+	n.RunDevice(name, n.devices[name])
+
+	ipad := newMockTcpConn("192.168.1.20:50001")
+	ipad.stall = make(chan bool)
+	laptop := newMockTcpConn("192.168.1.21:50002")
+	m.conns <- ipad
+	m.conns <- laptop
+	time.Sleep(100 * time.Millisecond)
+
+	send := "$HFHDM,200.5,M*2B"
+	for i := 0; i < 3; i++ {
+		n.Channels["to_tcp"] <- send
+	}
+	time.Sleep(100 * time.Millisecond)
+	if laptop.Sent() != strings.Repeat(send+"\r\n", 3) {
+		t.Errorf("A stalled client should not delay the others got <%s>", laptop.Sent())
+	}
+	if ipad.Sent() != "" {
+		t.Errorf("Stalled client should not have been written to got <%s>", ipad.Sent())
+	}
+
+	close(ipad.stall)
+	time.Sleep(100 * time.Millisecond)
+	if ipad.Sent() != strings.Repeat(send+"\r\n", 3) {
+		t.Errorf("Stalled client should be sent its queued sentences got <%s>", ipad.Sent())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+}
+
+func TestTcpServerTap(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_tap_config)
+	m := &mockTcpServerDevice{
+		conns:  make(chan *mockTcpConn, 1),
+		closed: make(chan bool),
+	}
+	n.TcpServerIoDevices["tcp_tail"] = m
+	n.monitor_active = true
+	n.RunContext(context.Background())
+
+	tail := newMockTcpConn("127.0.0.1:50001")
+	m.conns <- tail
+	time.Sleep(100 * time.Millisecond)
+	send := "$IIDPT,5.2,0.5*42"
+	n.Channels["to_dedup"] <- send
+	time.Sleep(100 * time.Millisecond)
+
+	if tail.Sent() != send+"\r\n" {
+		t.Errorf("Tap client should be sent a copy got <%s>", tail.Sent())
+	}
+	// the tapped channel still gets the sentence for the device reading it
+	if received := test_helpers.GetMessages(n.Channels["to_processor"]); len(received) != 1 || received[0] != send {
+		t.Errorf("Tapped channel should still receive the sentence got %s", received)
+	}
+
+	// a tap changed after the mux started needs a restart
+	n.Config.Values["tcp_tail"]["tap"] = []string{"to_dedup"}
+	n.RunDevice("tcp_tail", n.devices["tcp_tail"])
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{
+		"Tcp server <tcp_tail> tap of to_dedup is made when the mux starts - restart the mux",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not complete: %s", err)
+	}
+}
+
+func TestTcpServerEmptyMaxClients(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Tcp_config)
+	name := "tcp_opencpn"
+	n.Config.Values[name]["max_clients"] = []string{}
+	n.TcpServerIoDevices[name] = &mockTcpServerDevice{conns: make(chan *mockTcpConn), closed: make(chan bool)}
+	n.monitor_active = true
+	n.RunDevice(name, n.devices[name])
+
+	messages := test_helpers.GetMessages(monitor)
+	expected_messages := []string{"Tcp server <tcp_opencpn> max_clients must be a number greater than 0"}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
@@ -188,3 +188,507 @@ udp_autohelm:
     input: to_udp_autohelm
     server_address: 127.0.0.1:8007
 `
+
+var Tcp_config = `
+tcp_opencpn:
+    type: tcp_server
+    port: 10110
+    input: to_tcp
+    max_clients: 2
+    origin_tag: tcp_
+    client_tags:
+        - 192.168.1.20 == ipad_
+    outputs:
+        - from_tcp
+
+tcp_gateway:
+    type: tcp_client
+    server_address: 192.168.1.30:10110
+    origin_tag: gw_
+    input: from_tcp
+    outputs:
+        - to_tcp
+`
+
+var Tcp_tap_config = `
+gps_dedup:
+    type: dedup
+    input: to_dedup
+    outputs:
+        - to_processor
+
+tcp_tail:
+    type: tcp_server
+    port: 10111
+    tap: to_processor
+`
+
+var Capture_config = `
+recorder:
+    type: recorder
+    input: to_recorder
+    file_prefix: passage
+
+player:
+    type: player
+    file: passage.txt
+    speed: 10
+    outputs:
+        - to_recorder
+`
+
+var Checksum_config = `
+monitor:
+    type: monitor
+    report:
+        - device
+
+compass:
+    name: /dev/ttyUSB0
+    type: serial
+    origin_tag: cp_
+    checksum: require
+    report:
+        - checksum
+    outputs:
+      - to_processor
+
+gps:
+    name: /dev/ttyUSB2
+    type: serial
+    checksum: fix
+    outputs:
+      - to_processor
+`
+
+var Filter_config = `
+bridge:
+    name: /dev/ttyUSB1
+    type: serial
+    origin_tag: ray_
+    outputs:
+      - to_router
+
+router:
+    type: filter
+    input: to_router
+    routes:
+        vhf:
+            include:
+                - "!AIVDM"
+            outputs:
+                - to_vhf
+        autopilot:
+            include:
+                - sentence:RMC
+                - sentence:HDM
+            exclude:
+                - talker:II
+            outputs:
+                - to_autohelm
+        log:
+            include:
+                - tag:ray_
+                - regex:^\$..DPT
+            exclude:
+                - regex:^!
+            outputs:
+                - to_log
+
+vhf:
+    name: /dev/ttyUSB3
+    type: serial
+    input: to_vhf
+
+autohelm:
+    type: udp_client
+    input: to_autohelm
+    server_address: 127.0.0.1:8007
+
+logger:
+    type: recorder
+    input: to_log
+`
+
+var Throttle_config = `
+autopilot_rate:
+    type: throttle
+    input: to_throttle
+    baud: 4800
+    rates:
+        hdm: 2
+        rmc: 1
+    outputs:
+        - to_autohelm
+
+autohelm:
+    name: /dev/ttyUSB2
+    type: serial
+    baud: 4800
+    input: to_autohelm
+`
+
+var Rewrite_config = `
+instrument_rewrite:
+    type: rewrite
+    input: from_instruments
+    rules:
+        hdg_to_hdm:
+            match: IIHDG
+            talker: HC
+            sentence: HDM
+            strip_fields:
+                - 2
+                - 3
+                - 4
+                - 5
+            add_fields:
+                - M
+        bridge_talker:
+            match: YD
+            talker: II
+    outputs:
+        - to_autohelm
+`
+
+var Dedup_config = `
+opencpn_dedup:
+    type: dedup
+    input: to_dedup
+    window: 500
+    ignore_talker: on
+    outputs:
+        - to_udp_opencpn
+`
+
+var Reload_config = `
+steady_dedup:
+    type: dedup
+    input: to_steady
+    outputs:
+        - from_steady
+
+changing_dedup:
+    type: dedup
+    input: to_changing
+    window: 500
+    outputs:
+        - from_changing
+
+removed_dedup:
+    type: dedup
+    input: to_removed
+    outputs:
+        - from_removed
+`
+
+var Reloaded_config = `
+steady_dedup:
+    type: dedup
+    input: to_steady
+    outputs:
+        - from_steady
+
+changing_dedup:
+    type: dedup
+    input: to_changing
+    window: 200
+    outputs:
+        - from_changing
+
+added_dedup:
+    type: dedup
+    input: to_added
+    outputs:
+        - from_added
+`
+
+var Reader_config = `
+reader_dedup:
+    type: dedup
+    input: to_reader_dedup
+    outputs:
+        - from_reader_dedup
+`
+
+var Builder_config = `
+compass:
+    type: serial
+    name: /dev/ttyUSB0
+    baud: 38400
+    origin_tag: cp_
+    checksum: fix
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+    log_period: 15
+    data_retain: 30
+    datetime_tags:
+        - cp_
+
+compass_out:
+    type: make_sentence
+    processor: main_processor
+    sentence: hdm
+    every: 200
+    prefix: HF
+    use_origin_tag: cp_
+    if:
+        - cp_compass_status == 3333
+    outputs:
+        - to_udp_opencpn
+
+udp_opencpn:
+    type: udp_client
+    input: to_udp_opencpn
+    server_address: 192.168.1.14:8011
+`
+
+var Registry_config = `
+my_echo:
+    type: test_echo
+    input: to_echo
+    prefix: echoed_
+    outputs:
+        - from_echo
+
+bad_echo:
+    type: test_echo
+    input: to_bad_echo
+    outputs:
+        - from_echo
+`
+
+var Schema_config = `
+compass:
+    type: serial
+    baud: fast
+    bauds: 4800
+    outputs:
+        - to_processor
+
+listen:
+    type: udp_listen
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+
+compass_out:
+    type: make_sentence
+    processor: main_processor
+    sentence: hdm
+    every: 200
+    if: esp_auto
+    outputs:
+        - to_udp_opencpn
+
+udp_opencpn:
+    type: udp_client
+    input: to_udp_opencpn
+    server_address: 192.168.1.14
+`
+
+var Graph_config = `
+compass:
+    type: serial
+    name: /dev/ttyUSB0
+    origin_tag: cp_
+    outputs:
+        - to_processor
+        - to_nowhere
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+
+compass_out:
+    type: make_sentence
+    processor: main_processor
+    sentence: hdm
+    every: 200
+    outputs:
+        - to_udp_opencpn
+
+udp_opencpn:
+    type: udp_client
+    input: to_udp_opencpn
+    server_address: 192.168.1.14:8011
+
+udp_autohelm:
+    type: udp_client
+    input: to_udp_autohelm
+    server_address: 127.0.0.1:8007
+`
+
+var Logging_config = `
+main_monitor:
+    type: monitor
+    print: off
+    level: loud
+    format: xml
+`
+
+var Channel_config = `
+ais_listen:
+    type: udp_listen
+    port: 8006
+    outputs:
+        - to_ais
+        - to_autohelm
+
+udp_opencpn:
+    type: udp_client
+    input: to_ais
+    server_address: 192.168.1.14:8011
+
+udp_autohelm:
+    type: udp_client
+    input: to_autohelm
+    server_address: 127.0.0.1:8007
+
+to_ais:
+    type: channel
+    capacity: 3
+    policy: drop_oldest
+
+to_autohelm:
+    type: channel
+    capacity: 2
+    policy: block_with_timeout
+    timeout: 50
+`
+
+var Bad_channel_config = `
+ais_listen:
+    type: udp_listen
+    port: 8006
+    outputs:
+        - to_ais
+
+udp_opencpn:
+    type: udp_client
+    input: to_ais
+    server_address: 192.168.1.14:8011
+
+to_ais:
+    type: channel
+    capacity: 0
+    policy: shed
+    timeout: 50
+
+to_nowhere:
+    type: channel
+`
+
+var Serial_line_config = `
+seatalk_bridge:
+    type: serial
+    name: /dev/ttyUSB1
+    baud: 4800
+    data_bits: 7
+    parity: even
+    stop_bits: 1
+    flow_control: rts_cts
+    read_timeout: 200
+    dtr: off
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
+
+var Bad_serial_line_config = `
+seatalk_bridge:
+    type: serial
+    name: /dev/ttyUSB1
+    data_bits: 9
+    parity: evens
+    stop_bits: 1.5
+    flow_control: rts_cts
+    rts: off
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
+
+var Usb_serial_config = `
+gps:
+    type: serial
+    usb_vid: "0403"
+    usb_pid: "0x6001"
+    usb_serial: A9XK2L1
+    outputs:
+        - to_processor
+
+ais:
+    type: serial
+    name: /dev/serial/by-id/usb-Digital_Yacht*
+    baud: 38400
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
+
+var Baud_auto_config = `
+compass:
+    type: serial
+    name: /dev/ttyUSB0
+    baud: auto
+    baud_candidates: [4800, 38400, 115200]
+    baud_window: 30
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
+
+var Bad_baud_config = `
+compass:
+    type: serial
+    name: /dev/ttyUSB0
+    baud: auto
+    baud_candidates: [4800, fast]
+    baud_window: 0
+    outputs:
+        - to_processor
+
+gps:
+    type: serial
+    name: /dev/ttyUSB1
+    baud: 4800
+    baud_window: 500
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
+
+var Bad_usb_serial_config = `
+gps:
+    type: serial
+    usb_vid: "04x3"
+    outputs:
+        - to_processor
+
+main_processor:
+    type: nmea_processor
+    input: to_processor
+`
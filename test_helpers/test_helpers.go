@@ -16,7 +16,7 @@ func UnexpectedErrorMessage(message string, err error) bool {
 	return unexpected
 }
 
-func GetMessages(m chan string) []string {
+func GetMessages(m <-chan string) []string {
 	run_for := time.NewTicker(50 * time.Millisecond)
 	ret := make([]string, 0)
 
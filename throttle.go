@@ -0,0 +1,234 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes in the longest NMEA 0183 sentence with its CR LF
+const max_sentence_bytes = 82
+
+// Limits the rate of each sentence type and the total bytes per second so that
+// slow links are not overrun. When over budget only the latest sentence of each
+// type is kept to be sent as soon as the budget allows.
+type throttle struct {
+	min_gap       map[string]time.Duration // by sentence type
+	last_sent     map[string]time.Time
+	pending       map[string]string
+	order         []string // sentence types pending in order of arrival
+	bytes_per_sec float64  // zero for no byte budget
+	max_tokens    float64  // 1 second of budget but always room for a whole sentence
+	tokens        float64
+	last_fill     time.Time
+	over_budget   bool         // a pending sentence is waiting for the byte budget
+	stats         *deviceStats // counts the pending sentences replaced, may be nil
+}
+
+func newThrottle(rates map[string]float64, baud int, now time.Time) *throttle {
+	t := throttle{
+		min_gap:   make(map[string]time.Duration),
+		last_sent: make(map[string]time.Time),
+		pending:   make(map[string]string),
+		last_fill: now,
+	}
+	for sentence_type, rate := range rates {
+		t.min_gap[strings.ToUpper(sentence_type)] = time.Duration(float64(time.Second) / rate)
+	}
+	if baud > 0 {
+		// 10 bits per byte with start and stop bits
+		t.bytes_per_sec = float64(baud) / 10
+		t.max_tokens = max(t.bytes_per_sec, max_sentence_bytes)
+		t.tokens = t.bytes_per_sec
+	}
+	return &t
+}
+
+func throttleKey(str string) string {
+	_, sentence := trim_tag(str)
+	_, sentence_type := sentenceAddress(sentence)
+	return sentence_type
+}
+
+// Adds tokens for the time elapsed keeping at most max_tokens
+func (t *throttle) fill(now time.Time) {
+	if t.bytes_per_sec == 0 {
+		return
+	}
+	t.tokens = min(t.tokens+now.Sub(t.last_fill).Seconds()*t.bytes_per_sec, t.max_tokens)
+	t.last_fill = now
+}
+
+func (t *throttle) gapPassed(key string, now time.Time) bool {
+	if gap, found := t.min_gap[key]; found {
+		if last, sent := t.last_sent[key]; sent && now.Sub(last) < gap {
+			return false
+		}
+	}
+	return true
+}
+
+// A sentence longer than max_tokens can be sent once the budget is full
+func (t *throttle) inBudget(str string) bool {
+	_, sentence := trim_tag(str)
+	return t.bytes_per_sec == 0 || t.tokens >= min(float64(len(sentence)+2), t.max_tokens)
+}
+
+func (t *throttle) sent(key string, str string, now time.Time) {
+	t.last_sent[key] = now
+	if t.bytes_per_sec > 0 {
+		_, sentence := trim_tag(str)
+		t.tokens -= float64(len(sentence) + 2) // with CR LF
+	}
+}
+
+// Returns the sentence if it can be sent now otherwise holds it as the latest
+// of its type. Call release first as a new sentence does not use the byte
+// budget while a pending sentence is waiting for it.
+func (t *throttle) offer(str string, now time.Time) (string, bool) {
+	t.fill(now)
+	key := throttleKey(str)
+	if _, found := t.pending[key]; found {
+		t.pending[key] = str
+		t.stats.replace()
+		return "", false
+	}
+	if t.gapPassed(key, now) {
+		if !t.over_budget && t.inBudget(str) {
+			t.sent(key, str, now)
+			return str, true
+		}
+		t.over_budget = true
+	}
+	t.pending[key] = str
+	t.order = append(t.order, key)
+	return "", false
+}
+
+// Returns the pending sentences which can now be sent in order of arrival
+func (t *throttle) release(now time.Time) []string {
+	t.fill(now)
+	ready := make([]string, 0)
+	waiting := t.order[:0]
+	t.over_budget = false
+	for _, key := range t.order {
+		str := t.pending[key]
+		if !t.gapPassed(key, now) {
+			waiting = append(waiting, key)
+		} else if t.over_budget || !t.inBudget(str) {
+			// later sentences wait their turn so the oldest is not starved
+			t.over_budget = true
+			waiting = append(waiting, key)
+		} else {
+			t.sent(key, str, now)
+			delete(t.pending, key)
+			ready = append(ready, str)
+		}
+	}
+	t.order = waiting
+	return ready
+}
+
+func (n *NmeaMux) throttleProcess(name string) error {
+	// limits sentence rates from the input channel before sending to outputs
+	log := n.deviceLogger(name)
+	config := n.Config.Values[name]
+	error_str := ""
+
+	input := ""
+	if inputs, found := config["input"]; found && len(inputs) == 1 {
+		input = inputs[0]
+	} else {
+		error_str += "Invalid number of input settings must be exactly 1;"
+	}
+
+	baud := 0
+	if bauds, found := config["baud"]; found && len(bauds) > 0 {
+		if b, err := strconv.Atoi(bauds[0]); err == nil && b > 0 {
+			baud = b
+		} else {
+			error_str += "baud must be a number greater than 0;"
+		}
+	}
+
+	// rates.<sentence type> is the maximum sentences per second eg rates.hdm: 2
+	rates := make(map[string]float64)
+	for key, values := range config {
+		if sentence_type, found := strings.CutPrefix(key, "rates."); found {
+			if len(values) == 0 {
+				error_str += fmt.Sprintf("rate for %s has no value;", sentence_type)
+			} else if rate, err := strconv.ParseFloat(values[0], 64); err == nil && rate > 0 {
+				rates[sentence_type] = rate
+			} else {
+				error_str += fmt.Sprintf("rate for %s must be a number greater than 0;", sentence_type)
+			}
+		}
+	}
+
+	report := slices.Contains(config["report"], "on")
+
+	if len(error_str) > 0 {
+		log.Error(fmt.Sprintf("Throttle <%s> Errors: %s", name, error_str))
+		return fmt.Errorf("throttle %s has these errors:%s", name, error_str)
+	}
+
+	outputs := config["outputs"]
+	log.Info(fmt.Sprintf("Started throttle %s on %s baud %d rates %v", name, input, baud, rates))
+	n.goDevice(name, func(ctx context.Context) {
+		t := newThrottle(rates, baud, time.Now())
+		t.stats = n.deviceStats(name)
+		throttler(ctx, name, t, input, outputs, t.stats, n.deviceLogger(name), n.deviceChannels(name), report)
+	})
+	return nil
+}
+
+func throttler(ctx context.Context, name string, t *throttle, input string, outputs []string, stats *deviceStats, log *slog.Logger,
+	channels *map[string](chan string), report bool) {
+	release_ticker := time.NewTicker(20 * time.Millisecond)
+	defer release_ticker.Stop()
+	report_ticker := time.NewTicker(time.Minute)
+	defer report_ticker.Stop()
+	reported := int64(0)
+
+	send := func(str string) {
+		for _, out := range outputs {
+			if !stats.send(ctx, (*channels)[out], str) {
+				log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", str)
+			}
+		}
+	}
+
+	for {
+		select {
+		case str := <-(*channels)[input]:
+			stats.received(str)
+			now := time.Now()
+			for _, held := range t.release(now) {
+				send(held)
+			}
+			if out, ok := t.offer(str, now); ok {
+				send(out)
+			}
+		case now := <-release_ticker.C:
+			for _, str := range t.release(now) {
+				send(str)
+			}
+		case <-report_ticker.C:
+			if replaced := stats.replaced.Load(); report && replaced != reported {
+				log.Debug(fmt.Sprintf("Throttle %s has dropped %d older sentences", name, replaced), "category", category_device)
+				reported = replaced
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
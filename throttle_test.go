@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/martinmarsh/nmea-mux/test_data"
+	"github.com/martinmarsh/nmea-mux/test_helpers"
+)
+
+func TestThrottleRateKeepsLatest(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	th := newThrottle(map[string]float64{"hdm": 2}, 0, start)
+	th.stats = &deviceStats{}
+
+	if _, ok := th.offer("$HCHDM,200.1,M", start); !ok {
+		t.Error("First HDM should be sent")
+	}
+	// at 10Hz the next 4 arrive within the 500ms gap, only the latest is kept
+	for i, heading := range []string{"200.2", "200.3", "200.4", "200.5"} {
+		now := start.Add(time.Duration(i+1) * 100 * time.Millisecond)
+		if _, ok := th.offer("$HCHDM,"+heading+",M", now); ok {
+			t.Errorf("HDM %s should be held", heading)
+		}
+	}
+	// other types are not limited
+	if _, ok := th.offer("$SDDPT,5.2,0.5", start.Add(450*time.Millisecond)); !ok {
+		t.Error("DPT should not be limited")
+	}
+	if ready := th.release(start.Add(450 * time.Millisecond)); len(ready) != 0 {
+		t.Errorf("Released too early %s", ready)
+	}
+	ready := th.release(start.Add(500 * time.Millisecond))
+	if len(ready) != 1 || ready[0] != "$HCHDM,200.5,M" {
+		t.Errorf("Expected latest HDM got %s", ready)
+	}
+	if replaced := th.stats.replaced.Load(); replaced != 3 {
+		t.Errorf("Expected 3 replaced got %d", replaced)
+	}
+}
+
+func TestThrottleByteBudget(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	// 300 baud is 30 bytes a second
+	th := newThrottle(map[string]float64{}, 300, start)
+	if _, ok := th.offer("$HCHDM,200.1,M*2A", start); !ok {
+		t.Error("First sentence within budget should be sent")
+	}
+	if _, ok := th.offer("$SDDPT,5.2,0.5*5E", start); ok {
+		t.Error("Second sentence is over budget and should be held")
+	}
+	if ready := th.release(start.Add(100 * time.Millisecond)); len(ready) != 0 {
+		t.Errorf("Released before budget refilled %s", ready)
+	}
+	ready := th.release(start.Add(700 * time.Millisecond))
+	if len(ready) != 1 || ready[0] != "$SDDPT,5.2,0.5*5E" {
+		t.Errorf("Expected DPT after refill got %s", ready)
+	}
+}
+
+func TestThrottlePendingNotStarved(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	th := newThrottle(map[string]float64{}, 300, start)
+	th.offer("$HCHDM,200.1,M*2A", start)
+	if _, ok := th.offer("$SDDPT,5.2,0.5*5E", start); ok {
+		t.Error("DPT is over budget and should be held")
+	}
+	// enough budget for one sentence arrives with a new type, the held DPT goes first
+	now := start.Add(700 * time.Millisecond)
+	ready := th.release(now)
+	if len(ready) != 1 || ready[0] != "$SDDPT,5.2,0.5*5E" {
+		t.Errorf("Expected held DPT to be released first got %s", ready)
+	}
+	if _, ok := th.offer("$GPVTG,1.5,T*33", now); ok {
+		t.Error("VTG should wait for the budget")
+	}
+	// a new type arriving while VTG waits for the budget does not take it
+	now = now.Add(650 * time.Millisecond)
+	if _, ok := th.offer("$IIMTW,12.5,C*1E", now); ok {
+		t.Error("MTW should not take the budget from the held VTG")
+	}
+	ready = th.release(now)
+	if len(ready) != 1 || ready[0] != "$GPVTG,1.5,T*33" {
+		t.Errorf("Expected held VTG before MTW got %s", ready)
+	}
+}
+
+func TestThrottleLongSentenceAtLowBaud(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	// 110 baud is 11 bytes a second, less than one sentence
+	th := newThrottle(map[string]float64{}, 110, start)
+	long := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	if _, ok := th.offer(long, start); ok {
+		t.Error("RMC is over budget and should be held")
+	}
+	if ready := th.release(start.Add(10 * time.Second)); len(ready) != 1 || ready[0] != long {
+		t.Errorf("Expected RMC once the budget refilled got %s", ready)
+	}
+}
+
+func TestThrottleDevice(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Throttle_config)
+	n.monitor_active = true
+	if err := n.RunDevice("autopilot_rate", n.devices["autopilot_rate"]); err != nil {
+		t.Errorf("Throttle failed to start %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		n.Channels["to_throttle"] <- "@cp_@$HCHDM,200.5,M*2E"
+		time.Sleep(100 * time.Millisecond)
+	}
+	received := test_helpers.GetMessages(n.Channels["to_autohelm"])
+	// 5 sentences over 500ms at 2Hz
+	if len(received) < 1 || len(received) > 3 {
+		t.Errorf("Expected HDM to be limited to 2Hz got %d %s", len(received), received)
+	}
+	stats := n.Stats().Devices["autopilot_rate"]
+	if stats.Replaced == 0 || stats.SentencesOut+stats.Replaced != stats.SentencesIn {
+		t.Errorf("Expected each sentence to be sent or replaced got %+v", stats)
+	}
+}
+
+func TestThrottleEmptySettings(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Throttle_config)
+	n.Config.Values["autopilot_rate"]["baud"] = []string{}
+	n.Config.Values["autopilot_rate"]["rates.hdm"] = []string{}
+	err := n.RunDevice("autopilot_rate", n.devices["autopilot_rate"])
+	if err == nil || err.Error() != "throttle autopilot_rate has these errors:rate for hdm has no value;" {
+		t.Errorf("Expected an error for the empty rate got %v", err)
+	}
+}
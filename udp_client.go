@@ -6,13 +6,15 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package nmea_mux
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"github.com/martinmarsh/nmea-mux/io"
 	"time"
-	"slices"
 )
 
 func (n *NmeaMux) udpClientProcess(name string) error {
+	log := n.deviceLogger(name)
 	config := n.Config.Values[name]
 	server_addr := ""
 	bad_config := false
@@ -20,7 +22,7 @@ func (n *NmeaMux) udpClientProcess(name string) error {
 		if len(server_addrs) == 1 {
 			server_addr = server_addrs[0]
 		} else {
-			(n.Monitor_channel) <- fmt.Sprintf("Udp client <%s> has invalid number of server addresses must be exactly 1", name)
+			log.Error(fmt.Sprintf("Udp client <%s> has invalid number of server addresses must be exactly 1", name))
 			bad_config = true
 		}
 	}
@@ -30,58 +32,76 @@ func (n *NmeaMux) udpClientProcess(name string) error {
 		if len(inputs) == 1 {
 			input_channel = inputs[0]
 		} else {
-			(n.Monitor_channel) <- fmt.Sprintf("Udp client <%s> has invalid number of inputs must be exactly 1", name)
+			log.Error(fmt.Sprintf("Udp client <%s> has invalid number of inputs must be exactly 1", name))
 			bad_config = true
 		}
 	}
 	
 	report := false
-	if slices.Contains(n.monitor_report, "device"){
-		if reports, found := config["report"]; found {
-			for _, v := range(reports){
-				switch v{
-				case "tx":
-					report = true
-				case "on":
-					report = true
-				}
+	if reports, found := config["report"]; found {
+		for _, v := range(reports){
+			switch v{
+			case "tx":
+				report = true
+			case "on":
+				report = true
 			}
 		}
 	}
 	
 	if !bad_config {
-		(n.Monitor_channel) <- fmt.Sprintf("Started udp client %s sending messages from %s", name, input_channel)
-		go udpWriter(name, n.UdpClientIoDevices[name], server_addr, input_channel, &n.Monitor_channel, &n.Channels, report)
+		log.Info(fmt.Sprintf("Started udp client %s sending messages from %s", name, input_channel))
+		udp := n.UdpClientIoDevices[name]
+		n.goDevice(name, func(ctx context.Context) {
+			udpWriter(ctx, name, udp, server_addr, input_channel, n.deviceStats(name), n.deviceLogger(name), n.deviceChannels(name), report)
+		})
 	}
 	return nil
 }
 
-func udpWriter(name string, Udp io.UdpClient_interfacer, server_addr string, input string, monitor_channel *chan string,
+func udpWriter(ctx context.Context, name string, Udp io.UdpClient_interfacer, server_addr string, input string, stats *deviceStats, log *slog.Logger,
 	channels *map[string](chan string), report bool) {
 	err := Udp.Open(server_addr)
 
 	for err != nil {
-		*(monitor_channel) <- fmt.Sprintf("Could not open udp client %s on %s error: %s  ", name, Udp.RemoteAddr(), err)
-		time.Sleep(5 * time.Second)
+		log.Warn(fmt.Sprintf("Could not open udp client %s on %s error: %s  ", name, Udp.RemoteAddr(), err))
+		if !sleepContext(ctx, 5*time.Second) {
+			return
+		}
 		//ensure channel is cleared then retry
-		for i := 0; i > 1000; i++ {
-			<-(*channels)[input]
+		for cleared := false; !cleared; {
+			select {
+			case <-(*channels)[input]:
+			default:
+				cleared = true
+			}
+		}
+		if !sleepContext(ctx, 5*time.Second) {
+			return
 		}
-		time.Sleep(5 * time.Second)
 		err = Udp.Open(server_addr)
 	}
 	defer Udp.Close()
-	*(monitor_channel) <- fmt.Sprintf("Started Udp client %s sending to %s from %s",
-		name, Udp.RemoteAddr(), Udp.LocalAddr())
+	log.Info(fmt.Sprintf("Started Udp client %s sending to %s from %s",
+		name, Udp.RemoteAddr(), Udp.LocalAddr()))
 
 	for {
-		str := <-(*channels)[input]
+		var str string
+		select {
+		case str = <-(*channels)[input]:
+		case <-ctx.Done():
+			return
+		}
+		stats.received(str)
 		_, str = trim_tag(str)
 		_, err := Udp.Write(str)
 		if err != nil {
-			*(monitor_channel) <- fmt.Sprintf("Udp %s Write error: %s", name, err)
-		} else if report {
-				*(monitor_channel) <- fmt.Sprintf("UDP %s Tx:  %s", name, str)
+			log.Error(fmt.Sprintf("Udp %s Write error: %s", name, err))
+		} else {
+			stats.sent(str)
+			if report {
+				log.Debug(fmt.Sprintf("UDP %s Tx:  %s", name, str), "category", category_device)
+			}
 		}
 	}
 }
@@ -46,10 +46,11 @@ func (m *mockUdpClientDevice) Write(s string) (int, error) {
 /* Uncomment for integration test
 func TestUdpClientRealSend(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	n.RunDevice("udp_opencpn", n.devices["udp_opencpn"])
-	expected_chan_response_test(n.Monitor_channel, "Started udp client udp_opencpn sending messages from to_udp_opencpn", false, t)
-	expected_chan_response_test(n.Monitor_channel, "Started Udp client udp_opencpn sending to", false, t)
+	expected_chan_response_test(monitor, "Started udp client udp_opencpn sending messages from to_udp_opencpn", false, t)
+	expected_chan_response_test(monitor, "Started Udp client udp_opencpn sending to", false, t)
 	send := "Writing to a udp client this message"
 	(n.channels["to_udp_opencpn"]) <- send
 	time.Sleep(5000 * time.Millisecond)
@@ -59,6 +60,7 @@ func TestUdpClientRealSend(t *testing.T) {
 
 func TestUdpClientMockSend(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	m := &mockUdpClientDevice{
 		open_error:  nil,
@@ -67,7 +69,7 @@ func TestUdpClientMockSend(t *testing.T) {
 	n.UdpClientIoDevices["udp_opencpn"] = m
 
 	n.RunDevice("udp_opencpn", n.devices["udp_opencpn"])
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"Started Udp client udp_opencpn sending to 192.168.1.14:8011 from 127.0.0.1:8000",
 		"Started Udp client udp_opencpn sending to",
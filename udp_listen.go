@@ -6,20 +6,27 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package nmea_mux
 
 import (
+	"context"
 	"fmt"
 	"github.com/martinmarsh/nmea-mux/io"
-	"slices"
 )
 
 func (n *NmeaMux) udpListenerProcess(name string) error {
 	// listens on a port and writes to output channels
+	log := n.deviceLogger(name)
 	config := n.Config.Values[name]
-	server_port := config["port"][0]
+	server_port := ""
+	if ports, found := config["port"]; found && len(ports) == 1 {
+		server_port = ports[0]
+	} else {
+		log.Error(fmt.Sprintf("Udp_listen %s must have exactly 1 port", name))
+		return fmt.Errorf("udp_listen %s has no port", name)
+	}
 	to_chans := ""
 	for _, out := range config["outputs"] {
 		to_chans += fmt.Sprintf(" %s,", out)
 	}
-	(n.Monitor_channel) <- (fmt.Sprintf("Started Upd_listen; name: %s  Port: %s channels: %s", name, server_port, to_chans))
+	log.Info(fmt.Sprintf("Started Upd_listen; name: %s  Port: %s channels: %s", name, server_port, to_chans))
 
 	tag := ""
 
@@ -28,51 +35,76 @@ func (n *NmeaMux) udpListenerProcess(name string) error {
 	}
 
 	report := false
-	if slices.Contains(n.monitor_report, "device"){
-		if reports, found := config["report"]; found {
-			for _, v := range(reports){
-				switch v{
-				case "rx":
-					report = true
-				case "on":
-					report = true
-				}
+	if reports, found := config["report"]; found {
+		for _, v := range(reports){
+			switch v{
+			case "rx":
+				report = true
+			case "on":
+				report = true
 			}
 		}
 	}
 
 	if len(config["outputs"]) > 0 {
-		go n.udpListener(name, n.UdpServerIoDevices[name], server_port,  config["outputs"], tag, report)
+		server := n.UdpServerIoDevices[name]
+		if err := server.Listen(server_port); err != nil {
+			log.Error(fmt.Sprintf("Error; Upd_listen %s; action: ABORTED, error: %s", name, err.Error()))
+			return fmt.Errorf("udp_listen %s could not listen: %w", name, err)
+		}
+		// registered before the listener starts so that Shutdown always sees it
+		n.onStop(name, func() { server.Close() })
+		checksum := n.newChecksumFilter(name)
+		n.goDevice(name, func(ctx context.Context) {
+			n.udpListener(ctx, name, server, config["outputs"], tag, checksum, report)
+		})
 	}
 	return nil
 }
 
-func (n *NmeaMux) udpListener(name string, server io.UdpServer_interfacer, server_port string, outputs []string,
-	 tag string, report bool) {
+func (n *NmeaMux) udpListener(ctx context.Context, name string, server io.UdpServer_interfacer, outputs []string,
+	 tag string, checksum *checksumFilter, report bool) {
 
-	err := server.Listen(server_port)
-	if err != nil {
-		(n.Monitor_channel) <- fmt.Sprintf("Error; Upd_listen %s; action: ABORTED, error: %s", name, err.Error())
-		return
-	}
-	defer server.Close()
+	log := n.deviceLogger(name)
+	channels := n.deviceChannels(name)
+	stats := n.deviceStats(name)
+	framer := newLineFramer(max_line_len)
 
 	for {
 		str, err := server.Read() //should wait until value available but in testing will return immediately
+		if ctx.Err() != nil {
+			// closed on shutdown
+			return
+		}
 		if err != nil {
-			n.Monitor_channel <- fmt.Sprintf("Error; Upd_listen %s; Packet Error; action: ignored, error: %s", name, err.Error())
+			log.Error(fmt.Sprintf("Error; Upd_listen %s; Packet Error; action: ignored, error: %s", name, err.Error()))
+			stats.parseError()
 			return
-		} else {
+		}
+		// a datagram may hold several sentences and the last may have no end of line
+		framer.write([]byte(str + "\r\n"))
+		for {
+			line, err := framer.next()
+			if err != nil {
+				log.Error(fmt.Sprintf("Udp read error in %s error %s", name, err))
+				stats.parseError()
+				continue
+			}
+			if line == nil {
+				break
+			}
+			str := string(line)
+			stats.received(str)
 			if report {
-				n.Monitor_channel <- fmt.Sprintf("UDP %s Rx:  %s", name, str)
+				log.Debug(fmt.Sprintf("UDP %s Rx:  %s", name, str), "category", category_device)
+			}
+			var ok bool
+			if str, ok = checksum.filter(str); !ok {
+				continue
 			}
-			if len(str) > 0 {
-				for _, out := range outputs {
-					select {
-    				case (n.Channels)[out] <- tag + str:
-    				default:
-						fmt.Println("In UDP listen", name, "message '", tag, str, "' could not be put on", out, "channel - may be full")
-					}
+			for _, out := range outputs {
+				if !stats.send(ctx, (*channels)[out], tag+str) {
+					log.Warn("Sentence could not be put on channel - may be full", "channel", out, "sentence", tag+str)
 				}
 			}
 		}
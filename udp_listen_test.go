@@ -6,6 +6,8 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package nmea_mux
 
 import (
+	"context"
+	"errors"
 	"github.com/martinmarsh/nmea-mux/test_data"
 	"github.com/martinmarsh/nmea-mux/test_helpers"
 	"testing"
@@ -41,11 +43,12 @@ func (m *mockUdpServerDevice) Read() (string, error) {
 /* Using the real UPD output for integration test
 func TestUdpServerMockRealReceive(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
 	name := "udp_compass_listen"
 	n.RunDevice(name, n.devices[name])
 	time.Sleep(1000 * time.Millisecond)
-	expected_chan_response_test(n.Monitor_channel, "Started Upd_listen; name: udp_compass_listen  Port: 8006 channels:  to_processor", false, t)
+	expected_chan_response_test(monitor, "Started Upd_listen; name: udp_compass_listen  Port: 8006 channels:  to_processor", false, t)
 	str := <-(n.channels["to_processor"])
 	fmt.Println(str)
 }
@@ -54,8 +57,9 @@ func TestUdpServerMockRealReceive(t *testing.T) {
 // The mock works by injecting a mock io object as defined by the interface before calling run device
 func TestUdpServerMockReceive(t *testing.T) {
 	n := NewMux()
+	monitor := captureMonitor(n)
 	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
-	message := "Mock upd message received by udp server this message..."
+	message := "$HCHDM,200.5,M*2E"
 	name := "udp_compass_listen"
 	m := &mockUdpServerDevice{
 		open_error: nil,
@@ -67,7 +71,7 @@ func TestUdpServerMockReceive(t *testing.T) {
 	n.RunDevice(name, n.devices[name])
 	time.Sleep(1000 * time.Millisecond)
 
-	messages := test_helpers.GetMessages(n.Monitor_channel)
+	messages := test_helpers.GetMessages(monitor)
 	expected_messages := []string{
 		"Started Upd_listen; name: udp_compass_listen  Port: 8006 channels:  to_processor",
 	}
@@ -83,3 +87,59 @@ func TestUdpServerMockReceive(t *testing.T) {
 		t.Errorf("Should have sent <%s> but got <%s>", message, str[0])
 	}
 }
+
+func TestUdpServerDatagramSentences(t *testing.T) {
+	n := NewMux()
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	name := "udp_compass_listen"
+	n.Config.Values[name]["checksum"] = []string{"require"}
+	// gateways often send several sentences in one datagram
+	m := &mockUdpServerDevice{sent: "$HCHDM,200.5,M*2E\r\n$HCHDM,200.5,M*2F\r\n$IIDPT,5.2,0.5*42"}
+	n.monitor_active = true
+	n.UdpServerIoDevices[name] = m
+	n.RunDevice(name, n.devices[name])
+
+	received := test_helpers.GetMessages(n.Channels["to_processor"])
+	if len(received) != 2 || received[0] != "@esp_@$HCHDM,200.5,M*2E" || received[1] != "@esp_@$IIDPT,5.2,0.5*42" {
+		t.Errorf("Expected each valid sentence in the datagram got %s", received)
+	}
+	if stats := n.Stats().Devices[name]; stats.SentencesIn != 3 || stats.ChecksumErrors != 1 {
+		t.Errorf("Expected 3 sentences in and 1 checksum error got %+v", stats)
+	}
+}
+
+func TestUdpServerNoPort(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Schema_config)
+	n.monitor_active = true
+	if err := n.RunDevice("listen", n.devices["listen"]); err == nil {
+		t.Error("Udp listen without a port must fail to start")
+	}
+	messages := test_helpers.GetMessages(monitor)
+	if _, _, not_found, _ := test_helpers.MessagesIn([]string{"Udp_listen listen must have exactly 1 port"}, messages); not_found {
+		t.Errorf("Expected port error got %v", messages)
+	}
+}
+
+func TestUdpServerListenError(t *testing.T) {
+	n := NewMux()
+	monitor := captureMonitor(n)
+	n.LoadConfig("./test_data/", "config", "yaml", test_data.Good_config)
+	name := "udp_compass_listen"
+	n.UdpServerIoDevices[name] = &mockUdpServerDevice{open_error: errors.New("mock address in use")}
+	n.monitor_active = true
+	if err := n.RunDevice(name, n.devices[name]); err == nil {
+		t.Errorf("Expected an error when the port cannot be listened on")
+	}
+	messages := test_helpers.GetMessages(monitor)
+	if err := n.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected shutdown without a listener got %s", err)
+	}
+	expected_messages := []string{
+		"Error; Upd_listen udp_compass_listen; action: ABORTED, error: mock address in use",
+	}
+	if _, _, not_found, err := test_helpers.MessagesIn(expected_messages, messages); not_found {
+		t.Errorf("Monitor message error %s", err.Error())
+	}
+}
@@ -0,0 +1,410 @@
+/*
+Copyright © 2024 Martin Marsh martin@marshtrio.com
+Licensed under the Apache License, Version 2.0 (the "License");
+*/
+
+package nmea_mux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A problem found in the config with the device and setting it was found in
+type ConfigError struct {
+	Device  string
+	Key     string
+	Problem string
+	Fix     string // suggested change
+	wiring  bool   // channel wiring problems do not stop devices running
+}
+
+func (e ConfigError) Error() string {
+	where := e.Device
+	if e.Key != "" {
+		where = fmt.Sprintf("%s %s", e.Device, e.Key)
+	}
+	if e.Fix == "" {
+		return fmt.Sprintf("%s: %s", where, e.Problem)
+	}
+	return fmt.Sprintf("%s: %s - %s", where, e.Problem, e.Fix)
+}
+
+// Every problem found in a config, returned by LoadConfig and Validate
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return "config errors found: " + strings.Join(problems, "; ")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Returns true if any problem is more than channel wiring
+func (e ConfigErrors) blocking() bool {
+	for _, err := range e {
+		if !err.wiring {
+			return true
+		}
+	}
+	return false
+}
+
+type settingKind int
+
+const (
+	kind_text    settingKind = iota // a single value
+	kind_list                       // one or more values
+	kind_number                     // a whole number
+	kind_decimal                    // a number which may have decimals
+	kind_on_off
+	kind_address // host:port
+	kind_port
+	kind_checksum
+	kind_condition // list of variable == value
+	kind_baud      // a whole number or auto
+)
+
+type settingSpec struct {
+	kind     settingKind
+	required bool
+}
+
+type deviceSchema struct {
+	settings map[string]settingSpec
+	prefixes []string                                // nested settings eg rates.<sentence type>
+	check    func(config map[string][]string) string // further checks returning errors separated by ;
+}
+
+var (
+	spec_text     = settingSpec{kind: kind_text}
+	spec_list     = settingSpec{kind: kind_list}
+	spec_number   = settingSpec{kind: kind_number}
+	spec_on_off   = settingSpec{kind: kind_on_off}
+	spec_checksum = settingSpec{kind: kind_checksum}
+	spec_input    = settingSpec{kind: kind_text, required: true}
+	spec_outputs  = settingSpec{kind: kind_list, required: true}
+)
+
+var device_schemas = map[string]deviceSchema{
+	"serial": {
+		settings: map[string]settingSpec{
+			"name": spec_text, "usb_vid": spec_text, "usb_pid": spec_text, "usb_serial": spec_text,
+			"baud": {kind: kind_baud}, "baud_candidates": spec_list, "baud_window": spec_number,
+			"input": spec_text, "outputs": spec_list, "origin_tag": spec_text, "report": spec_list, "checksum": spec_checksum,
+			"data_bits": spec_number, "parity": spec_text, "stop_bits": spec_text, "flow_control": spec_text,
+			"read_timeout": spec_number, "dtr": spec_on_off, "rts": spec_on_off, "max_backoff": spec_number,
+		},
+		check: func(config map[string][]string) string {
+			_, port_errors := parseSerialPort(config)
+			_, baud_errors := parseSerialBaud(config)
+			_, error_str := parseSerialOptions(config)
+			return port_errors + baud_errors + error_str
+		},
+	},
+	"udp_client": {settings: map[string]settingSpec{
+		"server_address": {kind: kind_address, required: true}, "input": spec_input, "report": spec_list,
+	}},
+	"udp_listen": {settings: map[string]settingSpec{
+		"port": {kind: kind_port, required: true}, "outputs": spec_outputs, "origin_tag": spec_text,
+		"report": spec_list, "checksum": spec_checksum,
+	}},
+	"tcp_server": {settings: map[string]settingSpec{
+		"port": {kind: kind_port, required: true}, "input": spec_text, "tap": spec_text, "outputs": spec_list,
+		"max_clients": spec_number, "origin_tag": spec_text, "client_tags": spec_list, "report": spec_list, "checksum": spec_checksum,
+	}},
+	"tcp_client": {settings: map[string]settingSpec{
+		"server_address": {kind: kind_address, required: true}, "input": spec_text, "outputs": spec_list,
+		"max_backoff": spec_number, "origin_tag": spec_text, "report": spec_list, "checksum": spec_checksum,
+	}},
+	"nmea_processor": {settings: map[string]settingSpec{
+		"input": spec_text, "log_period": spec_number, "data_retain": spec_number, "datetime_tags": spec_list,
+		"add_now_var": spec_text, "data_parse": spec_list, "report": spec_list, "checksum": spec_checksum,
+	}},
+	"make_sentence": {settings: map[string]settingSpec{
+		"processor": spec_text, "sentence": {kind: kind_text, required: true}, "every": spec_number, "prefix": spec_text,
+		"use_origin_tag": spec_text, "then_origin_tag": spec_text, "else_origin_tag": spec_text,
+		"if": {kind: kind_condition}, "outputs": spec_outputs,
+	}},
+	"recorder": {settings: map[string]settingSpec{
+		"input": spec_input, "directory": spec_text, "file_prefix": spec_text,
+	}},
+	"player": {settings: map[string]settingSpec{
+		"file": {kind: kind_text, required: true}, "speed": {kind: kind_decimal}, "loop": spec_on_off,
+		"origin_tag": spec_text, "outputs": spec_list, "report": spec_list, "checksum": spec_checksum,
+	}},
+	"filter": {
+		settings: map[string]settingSpec{"input": spec_input, "report": spec_list},
+		prefixes: []string{"routes."},
+		check: func(config map[string][]string) string {
+			_, error_str := parseFilterRoutes(config)
+			return error_str
+		},
+	},
+	"throttle": {
+		settings: map[string]settingSpec{"input": spec_input, "outputs": spec_list, "baud": spec_number, "report": spec_list},
+		prefixes: []string{"rates."},
+	},
+	"rewrite": {
+		settings: map[string]settingSpec{"input": spec_input, "outputs": spec_list, "report": spec_list},
+		prefixes: []string{"rules."},
+		check: func(config map[string][]string) string {
+			_, error_str := parseRewriteRules(config)
+			return error_str
+		},
+	},
+	"dedup": {settings: map[string]settingSpec{
+		"input": spec_input, "outputs": spec_list, "window": spec_number, "ignore_talker": spec_on_off, "report": spec_list,
+	}},
+	"metrics": {settings: map[string]settingSpec{"port": {kind: kind_port, required: true}}},
+	"channel": {
+		settings: map[string]settingSpec{"capacity": spec_number, "policy": spec_text, "timeout": spec_number},
+		check: func(config map[string][]string) string {
+			_, error_str := parseChannelPolicy(config)
+			return error_str
+		},
+	},
+	"monitor": {
+		settings: map[string]settingSpec{
+			"name": spec_text, "server_address": {kind: kind_address}, "print": spec_on_off, "udp": spec_on_off, "report": spec_list,
+			"stats_period": spec_number, "level": spec_text, "format": spec_text,
+		},
+		check: checkMonitorLogging,
+	},
+}
+
+// Checks the loaded config against the settings each device type accepts
+// and that channels are wired together. Returns ConfigErrors or nil.
+func (n *NmeaMux) Validate() error {
+	if errs := validateConfig(n.Config); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateConfig(config *configData) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	for name, values := range config.Values {
+		device_type := configType(values)
+		if device_type == "" {
+			errs = append(errs, ConfigError{Device: name, Key: "type", Problem: "no device type",
+				Fix: "add a type setting eg type: serial"})
+			continue
+		}
+		schema, found := device_schemas[device_type]
+		if !found {
+			if device_type != "external" && !isRegisteredType(device_type) {
+				errs = append(errs, ConfigError{Device: name, Key: "type",
+					Problem: fmt.Sprintf("unknown device type %s", device_type),
+					Fix:     fmt.Sprintf("use one of %s", strings.Join(knownDeviceTypes(), ", "))})
+			}
+			// external and registered devices check their own settings
+			continue
+		}
+		errs = append(errs, validateDevice(name, schema, values)...)
+	}
+
+	errs = append(errs, validateWiring(config)...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Device != errs[j].Device {
+			return errs[i].Device < errs[j].Device
+		}
+		if errs[i].Key != errs[j].Key {
+			return errs[i].Key < errs[j].Key
+		}
+		return errs[i].Problem < errs[j].Problem
+	})
+	return errs
+}
+
+func validateDevice(name string, schema deviceSchema, values map[string][]string) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	keys := make([]string, 0, len(schema.settings)+1)
+	for key := range schema.settings {
+		keys = append(keys, key)
+	}
+	keys = append(keys, "type")
+	sort.Strings(keys)
+
+	for key, value := range values {
+		if key == "type" {
+			continue
+		}
+		spec, found := schema.settings[key]
+		if !found {
+			nested := slices.ContainsFunc(schema.prefixes, func(prefix string) bool {
+				return strings.HasPrefix(key, prefix)
+			})
+			if !nested {
+				errs = append(errs, ConfigError{Device: name, Key: key, Problem: "unknown setting",
+					Fix: suggestKey(key, keys)})
+			}
+			continue
+		}
+		if problem, fix := checkSetting(spec.kind, value); problem != "" {
+			errs = append(errs, ConfigError{Device: name, Key: key, Problem: problem, Fix: fix})
+		}
+	}
+
+	for _, key := range keys {
+		if spec, found := schema.settings[key]; found && spec.required {
+			if _, set := values[key]; !set {
+				errs = append(errs, ConfigError{Device: name, Key: key, Problem: "required setting is missing",
+					Fix: fmt.Sprintf("add a %s setting", key)})
+			}
+		}
+	}
+
+	if schema.check != nil {
+		for _, problem := range strings.Split(schema.check(values), ";") {
+			if problem != "" {
+				errs = append(errs, ConfigError{Device: name, Problem: problem})
+			}
+		}
+	}
+	return errs
+}
+
+// Returns the problem with a setting value and a suggested fix
+func checkSetting(kind settingKind, values []string) (string, string) {
+	if len(values) == 0 {
+		return "has no value", "give a value or remove the setting"
+	}
+	if kind != kind_list && kind != kind_condition && len(values) > 1 {
+		return fmt.Sprintf("must be a single value not %s", strings.Join(values, " ")),
+			"remove spaces or use only one value"
+	}
+	value := values[0]
+	switch kind {
+	case kind_number:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Sprintf("%s is not a whole number", value), "use digits only eg 4800"
+		}
+	case kind_baud:
+		if _, err := strconv.Atoi(value); err != nil && value != "auto" {
+			return fmt.Sprintf("%s is not a whole number", value), "use digits only eg 4800 or auto"
+		}
+	case kind_decimal:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Sprintf("%s is not a number", value), "use a number eg 1.5"
+		}
+	case kind_on_off:
+		if value != "on" && value != "off" {
+			return fmt.Sprintf("%s must be on or off", value), "use on or off"
+		}
+	case kind_address:
+		if _, port, err := net.SplitHostPort(value); err != nil || checkPort(port) != "" {
+			return fmt.Sprintf("%s is not an address", value), "use host:port eg 192.168.1.14:8011"
+		}
+	case kind_port:
+		if checkPort(value) != "" {
+			return fmt.Sprintf("%s is not a port", value), "use a number from 1 to 65535"
+		}
+	case kind_checksum:
+		if checkChecksumMode(value) != "" {
+			return fmt.Sprintf("%s is not a checksum setting", value), "use ignore, fix or require"
+		}
+	case kind_condition:
+		for _, condition := range values {
+			if _, ok := parseCondition(condition); !ok {
+				return fmt.Sprintf("%s is not a condition", condition),
+					"use a list of conditions of the form variable == value"
+			}
+		}
+	}
+	return "", ""
+}
+
+func validateWiring(config *configData) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	for channel, names := range config.InChannelList {
+		if config.OutChannelList[channel] == nil {
+			for _, name := range names {
+				errs = append(errs, ConfigError{Device: name, Key: "input", wiring: true,
+					Problem: fmt.Sprintf("channel %s is not an output of any device", channel),
+					Fix:     "add it to the outputs of a device or change the input"})
+			}
+		}
+	}
+	for channel, names := range config.OutChannelList {
+		if config.InChannelList[channel] == nil {
+			for _, name := range names {
+				errs = append(errs, ConfigError{Device: name, Key: "outputs", wiring: true,
+					Problem: fmt.Sprintf("channel %s is not the input of any device", channel),
+					Fix:     "set it as the input of a device or remove it"})
+			}
+		}
+	}
+	for _, channel := range config.TypeList["channel"] {
+		if config.InChannelList[channel] == nil && config.OutChannelList[channel] == nil {
+			errs = append(errs, ConfigError{Device: channel, Key: "type", wiring: true,
+				Problem: fmt.Sprintf("channel %s is not the input or an output of any device", channel),
+				Fix:     "name the section after the channel it sets"})
+		}
+	}
+	return errs
+}
+
+// Suggests the closest known setting to a misspelt key
+func suggestKey(key string, keys []string) string {
+	best, best_distance := "", 3
+	for _, k := range keys {
+		if d := editDistance(key, k); d < best_distance {
+			best, best_distance = k, d
+		}
+	}
+	if best != "" {
+		return fmt.Sprintf("did you mean %s?", best)
+	}
+	return fmt.Sprintf("remove it or use one of %s", strings.Join(keys, ", "))
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func knownDeviceTypes() []string {
+	types := slices.Clone(builtin_device_types)
+	device_types_mu.Lock()
+	for name := range device_types {
+		types = append(types, name)
+	}
+	device_types_mu.Unlock()
+	sort.Strings(types)
+	return types
+}
+
+func isRegisteredType(name string) bool {
+	_, found := registeredDeviceType(name)
+	return found
+}